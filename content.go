@@ -1,9 +1,10 @@
 package rrpc
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -32,7 +33,10 @@ func Enc(pb proto.Message) ([]byte, error) {
 	defer pbPool.Put(buf)
 	defer buf.Reset()
 
-	return buf.Bytes(), buf.Marshal(pb)
+	if err := buf.Marshal(pb); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil // buf is reused
 }
 
 const (
@@ -45,44 +49,195 @@ type Payload struct {
 	Route string // ->
 	Reply string // <-
 
-	Exp time.Time
+	Exp time.Time // deadline, zero for none
 	Typ string
 
 	CorId string
 	MsgId string
 	AppId string
 
-	Body []byte
+	Headers amqp.Table // application headers
+	Body    []byte
+
+	Status *Status // reply error
+
+	Tag         uint64 // delivery tag
+	Redelivered bool   // delivered before, possibly to a consumer that died
+	Attempts    int    // deliveries of the request, counting this one
+	ack         amqp.Acknowledger
+
+	gone <-chan bool // closed if the reply queue is lost
+	sent chan error  // result of publishing a request
+
+	retries int // failed publishes of a reply
 }
 
 func Conveyor() chan *Payload { return make(chan *Payload, cpus) }
 
 func Deliver(d *amqp.Delivery) *Payload {
 	return &Payload{
-		Route: "",
+		Route: d.RoutingKey,
 		Reply: d.ReplyTo,
-		Exp:   d.Timestamp,
+		Exp:   tableDeadline(d.Headers),
 		Typ:   d.Type,
 		CorId: d.CorrelationId,
 		MsgId: d.MessageId,
 		AppId: d.AppId,
-		Body:  d.Body,
+
+		Headers: d.Headers,
+		Body:    d.Body,
+
+		Status: tableStatus(d.Headers),
+
+		Tag:         d.DeliveryTag,
+		Redelivered: d.Redelivered,
+		Attempts:    deliveryAttempts(d),
+		ack:         d.Acknowledger,
+	}
+}
+
+// deliveryAttempts counts the deliveries of a message, including this one.
+// A classic queue does not count redeliveries, so a redelivered message
+// without the count of a quorum queue is one more than its headers record.
+func deliveryAttempts(d *amqp.Delivery) int {
+	n := tableAttempts(d.Headers)
+	if _, ok := tableInt(d.Headers, "x-delivery-count"); d.Redelivered && !ok {
+		n++
+	}
+	return n
+}
+
+// tableAttempts counts the deliveries of a message recorded in its headers,
+// by rrpc, the count of a quorum queue or the times it was dead-lettered,
+// plus this one.
+func tableAttempts(t amqp.Table) int {
+	n, _ := tableInt(t, "x-delivery-count")
+	if rec, ok := tableInt(t, headerAttempts); ok && rec-1 > n {
+		n = rec - 1
+	}
+
+	var dead int64
+	deaths, _ := t["x-death"].([]interface{})
+	for _, d := range deaths {
+		if d, ok := d.(amqp.Table); ok {
+			c, _ := tableInt(d, "count")
+			dead += c
+		}
+	}
+	if dead > n {
+		n = dead
+	}
+	return int(n) + 1
+}
+
+const (
+	headerError    = "rrpc-error"    // why a request was dead-lettered
+	headerAttempts = "rrpc-attempts" // deliveries of a request so far
+	headerQueue    = "rrpc-queue"    // queue it was dead-lettered from
+)
+
+// forward returns a copy of a request to publish to queue, recording its
+// attempts and taking over its acknowledgement.
+func forward(pl *Payload, queue string) *Payload {
+	fw := *pl
+	pl.ack = nil
+
+	fw.Headers = amqp.Table{}
+	for k, v := range pl.Headers {
+		fw.Headers[k] = v
+	}
+	fw.Headers[headerAttempts] = int64(pl.Attempts)
+
+	fw.Route = queue
+	fw.Status = nil
+	fw.gone = nil
+	fw.sent = nil
+	fw.retries = 0
+	return &fw
+}
+
+// deadLetter returns a copy of a request to publish to a dead letter queue,
+// taking over its acknowledgement.
+func deadLetter(pl *Payload, queue string, reason error) *Payload {
+	dl := forward(pl, queue)
+	dl.Headers[headerError] = reason.Error()
+	dl.Headers[headerQueue] = pl.Route
+	dl.Exp = time.Time{} // kept until inspected
+	return dl
+}
+
+// Ack acknowledges the delivery the payload was consumed from, if it is
+// still unacknowledged.
+func (pl *Payload) Ack() error {
+	if pl.ack == nil {
+		return nil
+	}
+	ack := pl.ack
+	pl.ack = nil
+	return ack.Ack(pl.Tag, false)
+}
+
+// Nack rejects the delivery the payload was consumed from, if it is still
+// unacknowledged.
+func (pl *Payload) Nack(requeue bool) error {
+	if pl.ack == nil {
+		return nil
+	}
+	ack := pl.ack
+	pl.ack = nil
+	return ack.Nack(pl.Tag, false, requeue)
+}
+
+const headerDeadline = "rrpc-deadline"
+
+func tableDeadline(t amqp.Table) time.Time {
+	v, _ := t[headerDeadline].(string)
+	exp, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}
 	}
+	return exp
 }
+
+// Expired reports whether the deadline of the payload has passed.
+func (pl *Payload) Expired() bool {
+	return !pl.Exp.IsZero() && !time.Now().Before(pl.Exp)
+}
+
+// Publish converts the payload, expiring it in the queue with its deadline.
 func (pl *Payload) Publish() amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range pl.Headers {
+		headers[k] = v
+	}
+	if pl.Status != nil {
+		pl.Status.table(headers)
+	}
+
+	var expiration string
+	if !pl.Exp.IsZero() {
+		headers[headerDeadline] = pl.Exp.UTC().Format(time.RFC3339Nano)
+
+		ttl := time.Until(pl.Exp) / time.Millisecond
+		if ttl < 0 {
+			ttl = 0
+		}
+		expiration = strconv.FormatInt(int64(ttl), 10)
+	}
+
 	return amqp.Publishing{
-		//Headers: amqp.Table,
+		Headers: headers,
 
 		ContentType:     "application/octet-stream", // TODO: type support
 		ContentEncoding: "",
 		//DeliveryMode    uint8     // Transient (0 or 1) or Persistent (2)
 		//Priority        uint8     // 0 to 9
-		CorrelationId: "",
+		CorrelationId: pl.CorId,
 		ReplyTo:       pl.Reply,
-		//Expiration: "",
-		MessageId: pl.MsgId,
-		Timestamp: pl.Exp,
-		Type:      pl.Typ,
+		Expiration:    expiration,
+		MessageId:     pl.MsgId,
+		Timestamp:     time.Now(),
+		Type:          pl.Typ,
 		//UserId:    "",
 		AppId: pl.AppId,
 
@@ -90,36 +245,55 @@ func (pl *Payload) Publish() amqp.Publishing {
 	}
 }
 func (pl *Payload) Context() (context.Context, context.CancelFunc) {
-	ctx, cancel := context.WithDeadline(context.Background(), pl.Exp)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if pl.Exp.IsZero() {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithDeadline(context.Background(), pl.Exp)
+	}
 
 	ctx = trace.NewContext(ctx, trace.New(pl.AppId, pl.CorId+"."+pl.MsgId))
 
+	if md := tableMD(pl.Headers); md != nil {
+		ctx = NewIncomingContext(ctx, md)
+	}
+	ctx = newTrailerContext(ctx)
+
 	return ctx, cancel
 }
 
+// newCorId returns a random 128 bit correlation id, unique across every
+// client sharing a reply queue.
+func newCorId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func (s *Service) NewPayload(queue, message, typ string, deadline time.Time, b []byte) *Payload {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	var cid string
-	for {
-		cid = fmt.Sprintf("%010d", atomic.AddUint32(&s.count, 1))
-		if _, ok := s.route[cid]; !ok {
-			break
-		}
+	var reply string
+	var gone <-chan bool
+	if s.transport != nil {
+		reply, gone = s.transport.ReplyTo()
 	}
 
 	return &Payload{
 		Route: queue,
-		Reply: s.rabbit.desc.Queue, // SELF: TODO <- FIXME
+		Reply: reply,
 
 		Exp: deadline,
-		Typ: TypeServe,
+		Typ: typ,
 
-		CorId: cid,
+		CorId: newCorId(),
 		MsgId: message, // <- string type
 		AppId: "",      // TODO
 
 		Body: b,
+
+		gone: gone,
+		sent: make(chan error, 1),
 	}
 }
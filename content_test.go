@@ -0,0 +1,48 @@
+package rrpc
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDeadlineHeaders(t *testing.T) {
+	exp := time.Now().Add(time.Minute)
+	p := (&Payload{Exp: exp}).Publish()
+
+	if ttl, err := strconv.Atoi(p.Expiration); err != nil || ttl <= 0 || ttl > 60000 {
+		t.Fatalf("bad expiration %q", p.Expiration)
+	}
+	if got := Deliver(&amqp.Delivery{Headers: p.Headers}); !got.Exp.Equal(exp) {
+		t.Fatalf("expected deadline %v, got %v", exp, got.Exp)
+	}
+
+	if p = (&Payload{}).Publish(); p.Expiration != "" {
+		t.Fatalf("unexpected expiration %q", p.Expiration)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	for _, c := range []struct {
+		headers     amqp.Table
+		redelivered bool
+		attempts    int
+	}{
+		{nil, false, 1},
+		{nil, true, 2},
+		{amqp.Table{headerAttempts: int64(2)}, false, 2},
+		{amqp.Table{headerAttempts: int64(2)}, true, 3},
+		{amqp.Table{"x-delivery-count": int64(2)}, true, 3},
+		{amqp.Table{"x-death": []interface{}{
+			amqp.Table{"count": int64(1), "reason": "rejected"},
+			amqp.Table{"count": int64(3), "reason": "expired"},
+		}}, false, 5},
+	} {
+		d := &amqp.Delivery{Headers: c.headers, Redelivered: c.redelivered}
+		if got := Deliver(d).Attempts; got != c.attempts {
+			t.Fatalf("%v, redelivered %v: expected %d attempts, got %d", c.headers, c.redelivered, c.attempts, got)
+		}
+	}
+}
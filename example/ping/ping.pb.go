@@ -58,7 +58,7 @@ var _ rrpc.Service
 // Client API for PingService service
 
 type PingServiceClient interface {
-	Ping(ctx context.Context, in *PingRequest) (*PingResponse, error)
+	Ping(ctx context.Context, in *PingRequest, opts ...rrpc.CallOption) (*PingResponse, error)
 }
 
 type pingServiceClient struct {
@@ -69,9 +69,9 @@ func NewPingServiceClient(cc *rrpc.Service) PingServiceClient {
 	return &pingServiceClient{cc}
 }
 
-func (c *pingServiceClient) Ping(ctx context.Context, in *PingRequest) (*PingResponse, error) {
+func (c *pingServiceClient) Ping(ctx context.Context, in *PingRequest, opts ...rrpc.CallOption) (*PingResponse, error) {
 	out := new(PingResponse)
-	err := c.cc.Invoke(ctx, "PingService", "Ping", in, out)
+	err := c.cc.Invoke(ctx, "PingService", "Ping", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -88,16 +88,22 @@ func RegisterPingServiceServer(s *rrpc.Service, srv PingServiceServer) {
 	s.RegisterService(&_PingService_serviceDesc, srv)
 }
 
-func _PingService_Ping_Handler(srv interface{}, ctx context.Context, b []byte) ([]byte, error) {
+func _PingService_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor rrpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PingRequest)
-	if err := rrpc.Dec(b, in); err != nil {
+	if err := dec(in); err != nil {
 		return nil, err
 	}
-	out, err := srv.(PingServiceServer).Ping(ctx, in)
-	if err != nil {
-		return nil, err
+	if interceptor == nil {
+		return srv.(PingServiceServer).Ping(ctx, in)
+	}
+	info := &rrpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/PingService/Ping",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PingServiceServer).Ping(ctx, req.(*PingRequest))
 	}
-	return rrpc.Enc(out)
+	return interceptor(ctx, in, info, handler)
 }
 
 var _PingService_serviceDesc = rrpc.ServiceDesc{
@@ -109,6 +115,7 @@ var _PingService_serviceDesc = rrpc.ServiceDesc{
 			Handler:    _PingService_Ping_Handler,
 		},
 	},
+	Streams: []rrpc.StreamDesc{},
 }
 
 var fileDescriptor0 = []byte{
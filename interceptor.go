@@ -0,0 +1,89 @@
+package rrpc
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// UnaryServerInfo describes the method being served to interceptors.
+type UnaryServerInfo struct {
+	Server     interface{} // implementation registered for the service
+	FullMethod string      // /service/method
+}
+
+// UnaryHandler calls the method implementation with the decoded request.
+type UnaryHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// UnaryServerInterceptor intercepts the call of a method, calling handler
+// to continue.
+type UnaryServerInterceptor func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error)
+
+// ChainUnaryInterceptor adds server interceptors, the first being the
+// outermost.
+func ChainUnaryInterceptor(interceptors ...UnaryServerInterceptor) ServiceOption {
+	return func(s *Service) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// chainUnaryServer combines interceptors into one, nil if there are none.
+func chainUnaryServer(interceptors []UnaryServerInterceptor) UnaryServerInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+
+	return func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+		return interceptors[0](ctx, req, info, chainedHandler(interceptors[1:], info, handler))
+	}
+}
+
+func chainedHandler(interceptors []UnaryServerInterceptor, info *UnaryServerInfo, handler UnaryHandler) UnaryHandler {
+	if len(interceptors) == 0 {
+		return handler
+	}
+	return func(ctx context.Context, req interface{}) (interface{}, error) {
+		return interceptors[0](ctx, req, info, chainedHandler(interceptors[1:], info, handler))
+	}
+}
+
+// UnaryInvoker sends a call and waits for its reply.
+type UnaryInvoker func(ctx context.Context, queue, method string, in, out proto.Message, opts ...CallOption) error
+
+// UnaryClientInterceptor intercepts a call made with Invoke or Notify,
+// calling invoker to continue. Options appended to opts, such as Header,
+// apply to the call. out is nil for one-way calls.
+type UnaryClientInterceptor func(ctx context.Context, queue, method string, in, out proto.Message, invoker UnaryInvoker, opts ...CallOption) error
+
+// ChainUnaryClientInterceptor adds client interceptors, the first being the
+// outermost.
+func ChainUnaryClientInterceptor(interceptors ...UnaryClientInterceptor) ServiceOption {
+	return func(s *Service) {
+		s.clientInterceptors = append(s.clientInterceptors, interceptors...)
+	}
+}
+
+// chainUnaryClient combines interceptors into one, nil if there are none.
+func chainUnaryClient(interceptors []UnaryClientInterceptor) UnaryClientInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+
+	return func(ctx context.Context, queue, method string, in, out proto.Message, invoker UnaryInvoker, opts ...CallOption) error {
+		return interceptors[0](ctx, queue, method, in, out, chainedInvoker(interceptors[1:], invoker), opts...)
+	}
+}
+
+func chainedInvoker(interceptors []UnaryClientInterceptor, invoker UnaryInvoker) UnaryInvoker {
+	if len(interceptors) == 0 {
+		return invoker
+	}
+	return func(ctx context.Context, queue, method string, in, out proto.Message, opts ...CallOption) error {
+		return interceptors[0](ctx, queue, method, in, out, chainedInvoker(interceptors[1:], invoker), opts...)
+	}
+}
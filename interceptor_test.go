@@ -0,0 +1,95 @@
+package rrpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	var calls []string
+	trace := func(name string) UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+			if _, ok := req.(*empty); !ok {
+				t.Errorf("%s: request not decoded, got %T", name, req)
+			}
+			calls = append(calls, name+" "+info.FullMethod)
+			return handler(ctx, req)
+		}
+	}
+	deny := func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/PingService/Fail" {
+			return nil, Errorf(PermissionDenied, "denied")
+		}
+		return handler(ctx, req)
+	}
+
+	srv, cli := memoryServices(pingDesc, []ServiceOption{
+		ChainUnaryInterceptor(trace("outer"), trace("inner")),
+		ChainUnaryInterceptor(deny),
+	}, nil)
+	defer srv.Close()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := cli.Invoke(ctx, "PingService", "Ping", &empty{}, &empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Invoke(ctx, "PingService", "Fail", &empty{}, &empty{}); Convert(err).Code != PermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	want := []string{
+		"outer /PingService/Ping", "inner /PingService/Ping",
+		"outer /PingService/Fail", "inner /PingService/Fail",
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("expected calls %q, got %q", want, calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("expected calls %q, got %q", want, calls)
+		}
+	}
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	var calls []string
+	trace := func(name string) UnaryClientInterceptor {
+		return func(ctx context.Context, queue, method string, in, out proto.Message, invoker UnaryInvoker, opts ...CallOption) error {
+			calls = append(calls, name+" "+queue+"/"+method)
+			return invoker(ctx, queue, method, in, out, opts...)
+		}
+	}
+	auth := func(ctx context.Context, queue, method string, in, out proto.Message, invoker UnaryInvoker, opts ...CallOption) error {
+		return invoker(ctx, queue, method, in, out, append(opts, Header("authorization", "token"))...)
+	}
+
+	s, m := memoryService("", ChainUnaryClientInterceptor(trace("outer"), auth), ChainUnaryClientInterceptor(trace("inner")))
+	go s.Listen()
+	defer s.Close()
+
+	errs := make(chan error)
+	go func() {
+		errs <- s.Invoke(context.Background(), "PingService", "Ping", &empty{}, &empty{}, CallTimeout(time.Second))
+	}()
+
+	pl := <-m.queue("PingService")
+	if v, _ := pl.Headers["authorization"].(string); v != "token" {
+		t.Fatalf("header not sent, got %v", pl.Headers)
+	}
+	if err := answer(m, pl, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 || calls[0] != "outer PingService/Ping" || calls[1] != "inner PingService/Ping" {
+		t.Fatalf("unexpected calls %q", calls)
+	}
+}
@@ -0,0 +1,180 @@
+package rrpc
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+var NoTrailer = errors.New("context carries no trailer")
+
+// MD is the metadata of a call, such as auth tokens or request ids, carried
+// in the headers of a payload. Keys are lowercase.
+type MD map[string][]string
+
+// Pairs returns the metadata of alternating keys and values.
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic("rrpc: Pairs got an odd number of arguments")
+	}
+	md := MD{}
+	for i := 0; i < len(kv); i += 2 {
+		md.Append(kv[i], kv[i+1])
+	}
+	return md
+}
+
+// Get returns the values of a key.
+func (md MD) Get(k string) []string { return md[strings.ToLower(k)] }
+
+// Set replaces the values of a key.
+func (md MD) Set(k string, vals ...string) { md[strings.ToLower(k)] = vals }
+
+// Append adds values to a key.
+func (md MD) Append(k string, vals ...string) {
+	k = strings.ToLower(k)
+	md[k] = append(md[k], vals...)
+}
+
+// Copy returns a deep copy of the metadata.
+func (md MD) Copy() MD {
+	c := make(MD, len(md))
+	for k, v := range md {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// Join merges metadata, appending the values of shared keys.
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = append(out[k], v...)
+		}
+	}
+	return out
+}
+
+const headerMD = "rrpc-md-"
+
+// table writes the metadata to headers, a single value as a string and
+// several as an array.
+func (md MD) table(t amqp.Table) {
+	for k, v := range md {
+		switch len(v) {
+		case 0:
+		case 1:
+			t[headerMD+k] = v[0]
+		default:
+			vals := make([]interface{}, len(v))
+			for i := range v {
+				vals[i] = v[i]
+			}
+			t[headerMD+k] = vals
+		}
+	}
+}
+
+// tableMD reads the metadata from headers, nil if there is none.
+func tableMD(t amqp.Table) MD {
+	var md MD
+	for k, v := range t {
+		if !strings.HasPrefix(k, headerMD) {
+			continue
+		}
+		if md == nil {
+			md = MD{}
+		}
+		k = strings.TrimPrefix(k, headerMD)
+
+		switch v := v.(type) {
+		case string:
+			md[k] = append(md[k], v)
+		case []interface{}:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					md[k] = append(md[k], s)
+				}
+			}
+		}
+	}
+	return md
+}
+
+type (
+	incomingKey struct{}
+	outgoingKey struct{}
+	trailerKey  struct{}
+)
+
+// NewIncomingContext returns a context carrying the metadata of a served
+// request.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns the metadata of the request being served.
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+// NewOutgoingContext returns a context whose calls send the metadata,
+// replacing any set before.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a context whose calls also send the
+// alternating keys and values.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+// FromOutgoingContext returns the metadata sent by calls made with ctx.
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// trailer collects the trailer a handler sends with its reply.
+type trailer struct {
+	mu *sync.Mutex
+	md MD
+}
+
+func newTrailerContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trailerKey{}, &trailer{mu: &sync.Mutex{}})
+}
+
+// SetTrailer adds metadata to the reply of the request being served.
+func SetTrailer(ctx context.Context, md MD) error {
+	tr, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return NoTrailer
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.md = Join(tr.md, md)
+	return nil
+}
+
+// trailerFromContext returns the trailer set by a handler.
+func trailerFromContext(ctx context.Context) MD {
+	tr, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return nil
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	return tr.md
+}
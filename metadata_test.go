@@ -0,0 +1,62 @@
+package rrpc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+func TestMDHeaders(t *testing.T) {
+	md := Pairs("Request-Id", "1", "tenant", "a", "tenant", "b")
+
+	headers := amqp.Table{headerCode: int64(OK)}
+	md.table(headers)
+
+	if got := tableMD(headers); !reflect.DeepEqual(got, md) {
+		t.Fatalf("expected %v, got %v", md, got)
+	}
+	if got := tableMD(amqp.Table{headerCode: int64(OK)}); got != nil {
+		t.Fatalf("expected no metadata, got %v", got)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Methods: []MethodDesc{
+			{
+				MethodName: "Ping",
+				Handler: pingHandler("Ping", func(ctx context.Context, req interface{}) (interface{}, error) {
+					md, _ := FromIncomingContext(ctx)
+					if err := SetTrailer(ctx, Pairs("tenant", md.Get("tenant")[0])); err != nil {
+						return nil, err
+					}
+					return req, nil
+				}),
+			},
+		},
+	}
+
+	srv, cli := memoryServices(desc, nil, nil)
+	defer srv.Close()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx = AppendToOutgoingContext(ctx, "Tenant", "acme")
+
+	var trailer MD
+	if err := cli.Invoke(ctx, "PingService", "Ping", &empty{}, &empty{}, Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if v := trailer.Get("tenant"); len(v) != 1 || v[0] != "acme" {
+		t.Fatalf("expected the tenant trailer, got %v", trailer)
+	}
+
+	if err := SetTrailer(ctx, Pairs("k", "v")); err != NoTrailer {
+		t.Fatalf("expected %v, got %v", NoTrailer, err)
+	}
+}
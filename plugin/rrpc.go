@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/golang/protobuf/proto"
 	pb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/golang/protobuf/protoc-gen-go/generator"
 )
@@ -91,6 +92,33 @@ var reservedClientName = map[string]bool{
 
 func unexport(s string) string { return strings.ToLower(s[:1]) + s[1:] }
 
+// E_OneWay is the rrpc.one_way method option declared in rrpc.proto.
+var E_OneWay = &proto.ExtensionDesc{
+	ExtendedType:  (*pb.MethodOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         50723,
+	Name:          "rrpc.one_way",
+	Tag:           "varint,50723,opt,name=one_way,json=oneWay",
+}
+
+func init() {
+	proto.RegisterExtension(E_OneWay)
+}
+
+// oneWay reports whether a unary method sets the rrpc.one_way option.
+// Its client publishes the request without waiting for a reply.
+func oneWay(method *pb.MethodDescriptorProto) bool {
+	if method.GetServerStreaming() || method.GetClientStreaming() || method.Options == nil {
+		return false
+	}
+	v, err := proto.GetExtension(method.Options, E_OneWay)
+	if err != nil {
+		return false
+	}
+	b, _ := v.(*bool)
+	return b != nil && *b
+}
+
 // generateClientSignature returns the client-side signature for a method.
 func (r *rrpc) generateClientSignature(servName string, method *pb.MethodDescriptorProto) string {
 	origMethName := method.GetName()
@@ -106,19 +134,32 @@ func (r *rrpc) generateClientSignature(servName string, method *pb.MethodDescrip
 	if method.GetServerStreaming() || method.GetClientStreaming() {
 		respName = servName + "_" + generator.CamelCase(origMethName) + "Client" // what is streaming
 	}
-	return fmt.Sprintf("%s(ctx %s.Context, %s) (%s, error)", methName, contextPkg, reqArg, respName)
+	if reqArg != "" {
+		reqArg += ", "
+	}
+	if oneWay(method) {
+		return fmt.Sprintf("%s(ctx %s.Context, %sopts ...%s.CallOption) error", methName, contextPkg, reqArg, rrpcPkg)
+	}
+	return fmt.Sprintf("%s(ctx %s.Context, %sopts ...%s.CallOption) (%s, error)", methName, contextPkg, reqArg, rrpcPkg, respName)
 }
 
 func (r *rrpc) generateClientMethod(servName, fullServName, serviceDescVar string, method *pb.MethodDescriptorProto, descExpr string) {
 	qname := fullServName     // Queue name
 	dtype := method.GetName() // Delivery type
-	//inType := r.typeName(method.GetInputType())
+	methName := generator.CamelCase(method.GetName())
+	inType := r.typeName(method.GetInputType())
 	outType := r.typeName(method.GetOutputType())
 
 	r.P("func (c *", unexport(servName), "Client) ", r.generateClientSignature(servName, method), "{")
+	if oneWay(method) {
+		r.P(`return c.cc.Notify(ctx, "`, qname, `", "`, dtype, `", in, opts...)`) // Publish only
+		r.P("}")
+		r.P()
+		return
+	}
 	if !method.GetServerStreaming() && !method.GetClientStreaming() {
 		r.P("out := new(", outType, ")")
-		r.P(`err := c.cc.Invoke(ctx, "`, qname, `", "`, dtype, `", in, out)`) // Call service
+		r.P(`err := c.cc.Invoke(ctx, "`, qname, `", "`, dtype, `", in, out, opts...)`) // Call service
 		r.P("if err != nil { return nil, err }")
 		r.P("return out, nil")
 		r.P("}")
@@ -126,8 +167,65 @@ func (r *rrpc) generateClientMethod(servName, fullServName, serviceDescVar strin
 		return
 	}
 
-	// stream ...
-	r.P("// FATAL: Streams not supported!")
+	streamType := unexport(servName) + methName + "Client"
+	r.P("stream, err := c.cc.NewStream(ctx, ", descExpr, `, "`, qname, `", "`, dtype, `", opts...)`)
+	r.P("if err != nil { return nil, err }")
+	r.P("x := &", streamType, "{stream}")
+	if !method.GetClientStreaming() {
+		r.P("if err := x.ClientStream.SendMsg(in); err != nil { return nil, err }")
+		r.P("if err := x.ClientStream.CloseSend(); err != nil { return nil, err }")
+	}
+	r.P("return x, nil")
+	r.P("}")
+	r.P()
+
+	genSend := method.GetClientStreaming()
+	genRecv := method.GetServerStreaming()
+	genCloseAndRecv := !method.GetServerStreaming()
+
+	// Stream auxiliary types and methods.
+	r.P("type ", servName, "_", methName, "Client interface {")
+	if genSend {
+		r.P("Send(*", inType, ") error")
+	}
+	if genRecv {
+		r.P("Recv() (*", outType, ", error)")
+	}
+	if genCloseAndRecv {
+		r.P("CloseAndRecv() (*", outType, ", error)")
+	}
+	r.P(rrpcPkg, ".ClientStream")
+	r.P("}")
+	r.P()
+
+	r.P("type ", streamType, " struct {")
+	r.P(rrpcPkg, ".ClientStream")
+	r.P("}")
+	r.P()
+
+	if genSend {
+		r.P("func (x *", streamType, ") Send(m *", inType, ") error {")
+		r.P("return x.ClientStream.SendMsg(m)")
+		r.P("}")
+		r.P()
+	}
+	if genRecv {
+		r.P("func (x *", streamType, ") Recv() (*", outType, ", error) {")
+		r.P("m := new(", outType, ")")
+		r.P("if err := x.ClientStream.RecvMsg(m); err != nil { return nil, err }")
+		r.P("return m, nil")
+		r.P("}")
+		r.P()
+	}
+	if genCloseAndRecv {
+		r.P("func (x *", streamType, ") CloseAndRecv() (*", outType, ", error) {")
+		r.P("if err := x.ClientStream.CloseSend(); err != nil { return nil, err }")
+		r.P("m := new(", outType, ")")
+		r.P("if err := x.ClientStream.RecvMsg(m); err != nil { return nil, err }")
+		r.P("return m, nil")
+		r.P("}")
+		r.P()
+	}
 }
 
 // generateServerSignature returns the server-side signature for a method.
@@ -154,28 +252,86 @@ func (r *rrpc) generateServerSignature(servName string, method *pb.MethodDescrip
 	return methName + "(" + strings.Join(reqArgs, ", ") + ") " + ret
 }
 
-func (r *rrpc) generateServerMethod(servName string, method *pb.MethodDescriptorProto) string {
+func (r *rrpc) generateServerMethod(servName, fullServName string, method *pb.MethodDescriptorProto) string {
 	methName := generator.CamelCase(method.GetName())
 	hname := fmt.Sprintf("_%s_%s_Handler", servName, methName)
 	inType := r.typeName(method.GetInputType())
-	//outType := r.typeName(method.GetOutputType())
+	outType := r.typeName(method.GetOutputType())
 
 	if !method.GetServerStreaming() && !method.GetClientStreaming() {
-		r.P("func ", hname, "(srv interface{}, ctx ", contextPkg, ".Context, b []byte) ([]byte, error) {")
+		r.P("func ", hname, "(srv interface{}, ctx ", contextPkg, ".Context, dec func(interface{}) error, interceptor ", rrpcPkg, ".UnaryServerInterceptor) (interface{}, error) {")
 		r.P("in := new(", inType, ")")
-		//r.P("if err := proto.Unmarshal(b, in); err != nil { return nil, err }")
-		r.P("if err := ", rrpcPkg, ".Dec(b, in); err != nil { return nil, err }")
-		r.P("out, err := srv.(", servName, "Server).", methName, "(ctx, in)")
-		r.P("if err != nil { return nil, err }")
-		r.P("return ", rrpcPkg, ".Enc(out)")
-		//r.P("return b, nil")
+		r.P("if err := dec(in); err != nil { return nil, err }")
+		r.P("if interceptor == nil { return srv.(", servName, "Server).", methName, "(ctx, in) }")
+		r.P("info := &", rrpcPkg, ".UnaryServerInfo{")
+		r.P("Server: srv,")
+		r.P("FullMethod: ", strconv.Quote(fmt.Sprintf("/%s/%s", fullServName, method.GetName())), ",")
+		r.P("}")
+		r.P("handler := func(ctx ", contextPkg, ".Context, req interface{}) (interface{}, error) {")
+		r.P("return srv.(", servName, "Server).", methName, "(ctx, req.(*", inType, "))")
+		r.P("}")
+		r.P("return interceptor(ctx, in, info, handler)")
 		r.P("}")
 		r.P()
 		return hname
 	}
 
-	// stream ...
-	r.P("// FATAL: Streams not supported!")
+	streamType := unexport(servName) + methName + "Server"
+	r.P("func ", hname, "(srv interface{}, stream ", rrpcPkg, ".ServerStream) error {")
+	if !method.GetClientStreaming() {
+		r.P("m := new(", inType, ")")
+		r.P("if err := stream.RecvMsg(m); err != nil { return err }")
+		r.P("return srv.(", servName, "Server).", methName, "(m, &", streamType, "{stream})")
+	} else {
+		r.P("return srv.(", servName, "Server).", methName, "(&", streamType, "{stream})")
+	}
+	r.P("}")
+	r.P()
+
+	genSend := method.GetServerStreaming()
+	genSendAndClose := !method.GetServerStreaming()
+	genRecv := method.GetClientStreaming()
+
+	// Stream auxiliary types and methods.
+	r.P("type ", servName, "_", methName, "Server interface {")
+	if genSend {
+		r.P("Send(*", outType, ") error")
+	}
+	if genSendAndClose {
+		r.P("SendAndClose(*", outType, ") error")
+	}
+	if genRecv {
+		r.P("Recv() (*", inType, ", error)")
+	}
+	r.P(rrpcPkg, ".ServerStream")
+	r.P("}")
+	r.P()
+
+	r.P("type ", streamType, " struct {")
+	r.P(rrpcPkg, ".ServerStream")
+	r.P("}")
+	r.P()
+
+	if genSend {
+		r.P("func (x *", streamType, ") Send(m *", outType, ") error {")
+		r.P("return x.ServerStream.SendMsg(m)")
+		r.P("}")
+		r.P()
+	}
+	if genSendAndClose {
+		r.P("func (x *", streamType, ") SendAndClose(m *", outType, ") error {")
+		r.P("return x.ServerStream.SendMsg(m)")
+		r.P("}")
+		r.P()
+	}
+	if genRecv {
+		r.P("func (x *", streamType, ") Recv() (*", inType, ", error) {")
+		r.P("m := new(", inType, ")")
+		r.P("if err := x.ServerStream.RecvMsg(m); err != nil { return nil, err }")
+		r.P("return m, nil")
+		r.P("}")
+		r.P()
+	}
 	return hname
 }
 
@@ -256,7 +412,7 @@ func (r *rrpc) generateService(file *generator.FileDescriptor, service *pb.Servi
 	// Server handler implementations.
 	var handlerNames []string
 	for _, method := range service.Method {
-		hname := r.generateServerMethod(servName, method)
+		hname := r.generateServerMethod(servName, fullServName, method)
 		handlerNames = append(handlerNames, hname)
 	}
 
@@ -275,6 +431,23 @@ func (r *rrpc) generateService(file *generator.FileDescriptor, service *pb.Servi
 		r.P("},")
 	}
 	r.P("},")
+	r.P("Streams: []", rrpcPkg, ".StreamDesc{")
+	for i, method := range service.Method {
+		if !method.GetServerStreaming() && !method.GetClientStreaming() {
+			continue
+		}
+		r.P("{")
+		r.P("StreamName: ", strconv.Quote(method.GetName()), ",")
+		r.P("Handler: ", handlerNames[i], ",")
+		if method.GetServerStreaming() {
+			r.P("ServerStreams: true,")
+		}
+		if method.GetClientStreaming() {
+			r.P("ClientStreams: true,")
+		}
+		r.P("},")
+	}
+	r.P("},")
 	r.P("}")
 	r.P()
 
@@ -2,12 +2,17 @@ package rrpc
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	//"github.com/golang/protobuf/proto"
 	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
 )
 
 var cpus = runtime.NumCPU()
@@ -16,136 +21,978 @@ var ChannelClosed = errors.New("channel closed")
 
 type RabbitDesc struct {
 	Url         string
-	Queue       string
+	Queue       string // served queue, empty for clients only
 	Wait        bool
-	Connections int
+	Connections int // connections dialed, defaults to one
+	Channels    int // channels per connection, defaults to one
+	Retries     int // redials before giving up, zero retries forever
+
+	PrefetchCount  int  // unacked deliveries per consumer, defaults to one
+	PrefetchSize   int  // unacked bytes per consumer, zero is unlimited
+	PrefetchGlobal bool // apply prefetch across the channel
+
+	DirectReply bool // receive replies with direct reply-to, not a reply queue
+
+	Confirm   bool // wait for the broker to confirm each publish
+	Mandatory bool // fail publishes routed to no queue, implies Confirm
+
+	QueueArgs amqp.Table // further arguments of the queue, such as x-queue-type
+
+	// Requests rejected or expired in the queue are routed through the dead
+	// letter exchange to the dead letter queue, as are requests the service
+	// fails to serve, with the reason in their headers. Changing these
+	// arguments of an existing queue fails its declaration.
+	DeadLetterExchange string
+	DeadLetterQueue    string // defaults to the queue name with a .dlq suffix
+
+	// MaxAttempts is the number of deliveries of a request before it is
+	// dead-lettered, zero is unlimited. Only redeliveries count, such as
+	// after a consumer died serving the request, so it needs Wait. A
+	// redelivered request is requeued with its count in the rrpc-attempts
+	// header, as a classic queue keeps none, and so are requests returned
+	// unserved on cancel or shutdown, without counting. Handler errors are
+	// replied to and never retried.
+	MaxAttempts int
+}
+
+// link is a pooled connection and the generation of its channels.
+type link struct {
+	conn  *amqp.Connection
+	gen   uint32
+	lost  chan loss
+	reply bool // holds the reply queue
+}
+
+// loss reports a failed channel of a link.
+type loss struct {
+	gen   uint32
+	reply bool
 }
 
 type Rabbit struct {
-	desc *RabbitDesc
-	conn *amqp.Connection
-	once *sync.Once
+	desc  *RabbitDesc
+	mu    *sync.Mutex
+	links []*link
 
 	in  chan *Payload
 	out chan *Payload
 
 	wg   *sync.WaitGroup
 	stop chan bool
+	errs chan error // fatal consumer errors
+
+	reply     string    // exclusive reply queue
+	replyGone chan bool // closed when the reply queue is lost
+
+	tags       uint32 // consumer tag count
+	consuming  *sync.WaitGroup
+	cancel     chan bool
+	cancelOnce *sync.Once
+	stopOnce   *sync.Once
 }
 
 // Initialise a new Rabbit
-func NewRabbit(rd *RabbitDesc, in chan *Payload, out chan *Payload) (*Rabbit, error) {
+func NewRabbit(rd *RabbitDesc) (*Rabbit, error) {
 	r := &Rabbit{
 		desc: rd,
-		once: &sync.Once{},
-		in:   in,
-		out:  out,
+		mu:   &sync.Mutex{},
+		in:   Conveyor(),
+		out:  Conveyor(),
 		wg:   &sync.WaitGroup{},
 		stop: make(chan bool),
+		errs: make(chan error, 1),
+
+		consuming:  &sync.WaitGroup{},
+		cancel:     make(chan bool),
+		cancelOnce: &sync.Once{},
+		stopOnce:   &sync.Once{},
 	}
 
-	for i := 0; i < r.desc.Connections; i++ {
+	for i := 0; i < r.connections(); i++ {
 		log.Println("connecting...")
 		if err := r.NewConn(); err != nil {
+			r.Close()
 			return nil, err
 		}
 	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		if err := r.Manage(); err != nil {
+			log.Println("ERR: ", err)
+			r.fail(err)
+		}
+	}()
 	return r, nil
 }
 
-func (r *Rabbit) NewConn() (err error) {
-	log.Println("dialing")
-	r.once.Do(func() { r.conn, err = amqp.Dial(r.desc.Url) })
+func (r *Rabbit) connections() int {
+	if r.desc.Connections < 1 {
+		return 1
+	}
+	return r.desc.Connections
+}
+
+func (r *Rabbit) channels() int {
+	if r.desc.Channels < 1 {
+		return 1
+	}
+	return r.desc.Channels
+}
+
+func (r *Rabbit) prefetch() int {
+	if r.desc.PrefetchCount < 1 {
+		return 1
+	}
+	return r.desc.PrefetchCount
+}
+
+// Inflight is the number of deliveries the broker may push before any ack.
+func (r *Rabbit) Inflight() int {
+	return r.prefetch() * r.channels() * r.connections()
+}
+
+// NewConn dials a pooled connection and opens its channels.
+func (r *Rabbit) NewConn() error {
+	r.mu.Lock()
+	l := &link{lost: make(chan loss), reply: len(r.links) == 0}
+	r.mu.Unlock()
+
+	if err := r.dial(l); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.links = append(r.links, l)
+	return nil
+}
+
+// dial replaces the connection of a link, opening a new generation of
+// channels on it.
+func (r *Rabbit) dial(l *link) error {
+	conn, err := amqp.Dial(r.desc.Url)
 	if err != nil {
 		return err
 	}
-	log.Println("dial")
 
-	ch, err := r.conn.Channel()
+	r.mu.Lock()
+	l.conn = conn
+	l.gen++
+	r.mu.Unlock()
+
+	for i := 0; i < r.channels(); i++ {
+		if err := r.open(l); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	switch {
+	case l.reply && r.desc.DirectReply:
+		r.dropReply()
+	case l.reply:
+		if err := r.openReply(l); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens a channel on a link, declaring the queue and consuming from it
+// unless the rabbit has been cancelled.
+func (r *Rabbit) open(l *link) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, err := l.conn.Channel()
 	if err != nil {
 		return err
 	}
 
-	log.Println("channel")
+	direct, err := r.consumeDirect(ch)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	if r.desc.Queue == "" {
+		r.start(l, ch, nil, direct, false) // only publish
+		return nil
+	}
+
+	if err := r.declareDeadLetter(ch); err != nil {
+		ch.Close()
+		return err
+	}
 
 	q, err := ch.QueueDeclare(
-		r.desc.Queue, // name
-		true,         // durable
-		false,        // delete when usused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
+		r.desc.Queue,  // name
+		true,          // durable
+		false,         // delete when usused
+		false,         // exclusive
+		false,         // no-wait
+		r.queueArgs(), // arguments
 	)
 	if err != nil {
+		ch.Close()
 		return err
 	}
 
-	log.Println("queue")
-
 	if err = ch.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
+		r.prefetch(),          // prefetch count
+		r.desc.PrefetchSize,   // prefetch size
+		r.desc.PrefetchGlobal, // global
 	); err != nil {
+		ch.Close()
 		return err
 	}
 
-	log.Println("qos")
+	var c *consumer
+	select {
+	case <-r.cancel:
+		// draining, only publish
+	default:
+		tag := fmt.Sprintf("rrpc.%s.%d", q.Name, atomic.AddUint32(&r.tags, 1))
+		consume, err := ch.Consume(
+			q.Name,       // queue
+			tag,          // consumer
+			!r.desc.Wait, // auto-ack
+			false,        // exclusive
+			false,        // no-local
+			false,        // no-wait
+			nil,          // args
+		)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+		c = &consumer{tag, consume, r.desc.Wait}
+	}
+
+	r.start(l, ch, c, direct, false)
+	return nil
+}
 
+// queueArgs returns the arguments the served queue is declared with.
+func (r *Rabbit) queueArgs() amqp.Table {
+	args := amqp.Table{}
+	for k, v := range r.desc.QueueArgs {
+		args[k] = v
+	}
+	if r.desc.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = r.desc.DeadLetterExchange
+		args["x-dead-letter-routing-key"] = r.deadLetterQueue()
+	}
+	return args
+}
+
+func (r *Rabbit) deadLetterQueue() string {
+	if r.desc.DeadLetterQueue == "" {
+		return r.desc.Queue + ".dlq"
+	}
+	return r.desc.DeadLetterQueue
+}
+
+// declareDeadLetter declares the dead letter exchange and queue, if any.
+func (r *Rabbit) declareDeadLetter(ch *amqp.Channel) error {
+	if r.desc.DeadLetterExchange == "" {
+		return nil
+	}
+
+	if err := ch.ExchangeDeclare(
+		r.desc.DeadLetterExchange, // name
+		"direct",                  // kind
+		true,                      // durable
+		false,                     // delete when unused
+		false,                     // internal
+		false,                     // no-wait
+		nil,                       // arguments
+	); err != nil {
+		return err
+	}
+
+	dlq := r.deadLetterQueue()
+	if _, err := ch.QueueDeclare(
+		dlq,   // name
+		true,  // durable
+		false, // delete when usused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	); err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		dlq,                       // queue
+		dlq,                       // routing key
+		r.desc.DeadLetterExchange, // exchange
+		false,                     // no-wait
+		nil,                       // arguments
+	)
+}
+
+func (r *Rabbit) MaxAttempts() int { return r.desc.MaxAttempts }
+
+// Requeue returns a request to the served queue. With MaxAttempts it is
+// published again with its attempts, so the broker does not count this
+// delivery, and is otherwise rejected.
+func (r *Rabbit) Requeue(pl *Payload) error {
+	if r.desc.MaxAttempts > 0 {
+		return r.Publish(context.Background(), forward(pl, r.desc.Queue))
+	}
+	return pl.Nack(true)
+}
+
+// DeadLetter publishes a request the service failed to serve to the dead
+// letter queue, acknowledging it once published. Without a dead letter
+// exchange it is rejected.
+func (r *Rabbit) DeadLetter(pl *Payload, reason error) error {
+	if r.desc.DeadLetterExchange == "" {
+		return pl.Nack(false)
+	}
+	return r.Publish(context.Background(), deadLetter(pl, r.deadLetterQueue(), reason))
+}
+
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+// consumeDirect consumes direct replies to requests published on a channel,
+// if enabled.
+func (r *Rabbit) consumeDirect(ch *amqp.Channel) (*consumer, error) {
+	if !r.desc.DirectReply {
+		return nil, nil
+	}
+
+	select {
+	case <-r.cancel:
+		return nil, nil // no more replies
+	default:
+	}
+
+	tag := fmt.Sprintf("rrpc.direct.%d", atomic.AddUint32(&r.tags, 1))
 	consume, err := ch.Consume(
-		q.Name,       // queue
-		"",           // consumer
-		!r.desc.Wait, // auto-ack
-		false,        // exclusive
-		false,        // no-local
-		false,        // no-wait
-		nil,          // args
+		directReplyTo, // queue
+		tag,           // consumer
+		true,          // auto-ack
+		false,         // exclusive
+		false,         // no-local
+		false,         // no-wait
+		nil,           // args
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &consumer{tag, consume, false}, nil
+}
+
+// openReply opens a channel consuming a new exclusive, server named reply
+// queue, which is deleted with the channel.
+func (r *Rabbit) openReply(l *link) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.cancel:
+		return nil // no more replies
+	default:
+	}
+
+	ch, err := l.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when usused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
 	)
 	if err != nil {
+		ch.Close()
 		return err
 	}
 
-	log.Println("consume")
+	tag := fmt.Sprintf("rrpc.%s.%d", q.Name, atomic.AddUint32(&r.tags, 1))
+	consume, err := ch.Consume(
+		q.Name, // queue
+		tag,    // consumer
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		ch.Close()
+		return err
+	}
 
+	r.reply = q.Name
+	r.replyGone = make(chan bool)
+	r.start(l, ch, &consumer{tag, consume, false}, nil, true)
+	return nil
+}
+
+// dropReply fails calls waiting on the lost reply queue. Direct replies are
+// lost with the channel the request was published on, which is not tracked,
+// so any lost channel fails every call waiting on one.
+func (r *Rabbit) dropReply() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.replyGone != nil {
+		close(r.replyGone)
+	}
+	r.reply = ""
+	r.replyGone = nil
+
+	if r.desc.DirectReply {
+		r.reply = directReplyTo
+		r.replyGone = make(chan bool)
+	}
+}
+
+// ReplyTo returns the reply queue and a channel closed once it is lost.
+func (r *Rabbit) ReplyTo() (string, <-chan bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reply, r.replyGone
+}
+
+// start serves a channel, reporting its failure to the manager of the link.
+func (r *Rabbit) start(l *link, ch *amqp.Channel, c, direct *consumer, reply bool) {
+	if c != nil || direct != nil {
+		r.consuming.Add(1)
+	}
+
+	lost := loss{gen: l.gen, reply: reply}
+
+	r.wg.Add(1)
 	go func() {
-		if err := func() error {
-			defer r.wg.Done()
-			defer ch.Close()
+		defer r.wg.Done()
 
+		if err := r.serve(ch, c, direct); err != nil {
+			log.Println("ERR: ", err)
+			select {
+			case l.lost <- lost:
+			case <-r.stop:
+			}
+		}
+	}()
+}
+
+// consumer is a consumer of deliveries on a channel.
+type consumer struct {
+	tag        string
+	deliveries <-chan amqp.Delivery
+	wait       bool // acked once handled
+}
+
+// serve publishes outgoing payloads and delivers incoming ones on a channel
+// until the rabbit is stopped. All channels share the outgoing conveyor, so
+// publishes are spread over whichever channels are free. Direct replies to
+// requests published on the channel arrive on the direct consumer.
+func (r *Rabbit) serve(ch *amqp.Channel, c, direct *consumer) error {
+	defer ch.Close()
+
+	var u *unconfirmed
+	var confirms <-chan amqp.Confirmation
+	var returns <-chan amqp.Return
+	if r.confirm() {
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+		u = &unconfirmed{}
+		confirms = ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer))
+		if r.desc.Mandatory {
+			returns = ch.NotifyReturn(make(chan amqp.Return, confirmBuffer))
+		}
+		defer func() {
+			u.fail(r, fmt.Errorf("%w: %v", PublishFailed, ChannelClosed))
+		}()
+	}
+
+	// confirm settles the oldest publish, after any return preceding it.
+	confirm := func(cf amqp.Confirmation) {
+		for drained := false; !drained; {
+			select {
+			case ret := <-returns:
+				u.returned(ret)
+			default:
+				drained = true
+			}
+		}
+		if pl, err := u.pop(cf.Ack); pl != nil {
+			r.settle(pl, err)
+		}
+	}
+
+	consuming := c != nil || direct != nil
+	done := func() {
+		if consuming {
+			consuming = false
+			r.consuming.Done()
+		}
+	}
+	defer done()
+
+	var consume, replies <-chan amqp.Delivery
+	if c != nil {
+		consume = c.deliveries
+	}
+	if direct != nil {
+		replies = direct.deliveries
+	}
+
+	cancel := r.cancel
+	if !consuming {
+		cancel = nil
+	}
+
+	// stop cancels the consumers, requeueing d if it came from one.
+	stop := func(from *consumer, d *amqp.Delivery) error {
+		cancel = nil
+		for _, cc := range []*consumer{c, direct} {
+			if cc == nil {
+				continue
+			}
+			var nd *amqp.Delivery
+			if cc == from {
+				nd = d
+			}
+			if err := r.requeue(ch, cc, nd, u); err != nil {
+				return err
+			}
+		}
+		consume, replies = nil, nil
+		done()
+		return nil
+	}
+
+	// A delivery is handed to the service while publishing goes on, so
+	// replies are never stuck behind a full conveyor. Consuming pauses
+	// until it is taken.
+	var pending *Payload
+	var pendingFrom *consumer
+	var pendingD *amqp.Delivery
+	deliver := func(from *consumer, d *amqp.Delivery) {
+		pending = Deliver(d)
+		if !from.wait {
+			pending.ack = nil // auto-acked
+		}
+		pendingFrom, pendingD = from, d
+	}
+
+	for {
+		in, fromConsume, fromReplies := r.in, consume, replies
+		if pending == nil {
+			in = nil
+		} else {
+			fromConsume, fromReplies = nil, nil
+		}
+
+		select {
+		case in <- pending:
+			pending, pendingFrom, pendingD = nil, nil, nil
+
+		case pl, ok := <-r.out:
+			if !ok {
+				return ChannelClosed
+			}
+			if err := r.publish(ch, pl, u); err != nil {
+				if pl.sent == nil {
+					r.republish(pl) // callers are told
+				}
+				return err
+			}
+
+		case cf, ok := <-confirms:
+			if !ok {
+				return ChannelClosed
+			}
+			confirm(cf)
+
+		case ret := <-returns:
+			u.returned(ret)
+
+		case <-cancel:
+			if err := stop(pendingFrom, pendingD); err != nil {
+				return err
+			}
+			pending, pendingFrom, pendingD = nil, nil, nil
+
+		case <-r.stop:
+			// flush replies of drained handlers
 			for {
-				log.Println(r.desc.Queue, "...")
 				select {
-				case pl, ok := <-r.out:
-					if !ok {
-						return ChannelClosed
-					}
-					if err = ch.Publish("", pl.Route, false, false, pl.Publish()); err != nil {
+				case pl := <-r.out:
+					if err := r.publish(ch, pl, u); err != nil {
 						return err
 					}
-
-				case <-r.stop:
+				default:
+					// wait for outstanding confirms
+					for u != nil && len(*u) > 0 {
+						cf, ok := <-confirms
+						if !ok {
+							return ChannelClosed
+						}
+						confirm(cf)
+					}
 					return nil
+				}
+			}
 
-				case d, ok := <-consume:
-					if !ok {
-						return ChannelClosed
-					}
+		case d, ok := <-fromConsume:
+			if !ok {
+				return ChannelClosed
+			}
+			deliver(c, &d)
 
-					r.in <- Deliver(&d)
+		case d, ok := <-fromReplies:
+			if !ok {
+				return ChannelClosed
+			}
+			deliver(direct, &d)
+		}
+	}
+}
 
-					if err := d.Ack(false); err != nil {
-						return err
-					}
-				}
+// publish publishes a payload, settling it once published or, in confirm
+// mode, once confirmed.
+func (r *Rabbit) publish(ch *amqp.Channel, pl *Payload, u *unconfirmed) error {
+	err := ch.Publish("", pl.Route, r.desc.Mandatory, false, pl.Publish())
+	if err != nil {
+		if pl.sent != nil {
+			pl.sent <- fmt.Errorf("%w: %v", PublishFailed, err)
+		}
+		return err
+	}
+
+	if u != nil {
+		u.push(pl)
+		return nil
+	}
+	r.settle(pl, nil)
+	return nil
+}
+
+// settle reports the result of a request to its caller. A published reply
+// acknowledges the request it replies to, an unroutable one is dropped as
+// its caller is gone, and any other is republished.
+func (r *Rabbit) settle(pl *Payload, err error) {
+	if pl.sent != nil {
+		pl.sent <- err
+		return
+	}
+
+	switch {
+	case err == nil, errors.Is(err, Unroutable):
+		if err := pl.Ack(); err != nil {
+			log.Println("ack:", err)
+		}
+	default:
+		r.republish(pl)
+	}
+}
+
+func (r *Rabbit) confirm() bool { return r.desc.Confirm || r.desc.Mandatory }
+
+const confirmBuffer = 64
+
+// unconfirmed are the payloads published on a channel in confirm mode,
+// confirmed by the broker in publishing order.
+type unconfirmed []*confirmation
+
+type confirmation struct {
+	pl  *Payload
+	err error // returned by the broker
+}
+
+func (u *unconfirmed) push(pl *Payload) {
+	*u = append(*u, &confirmation{pl: pl})
+}
+
+// returned marks the oldest matching payload as unroutable.
+func (u *unconfirmed) returned(ret amqp.Return) {
+	for _, c := range *u {
+		if c.err == nil && c.pl.CorId == ret.CorrelationId && c.pl.Route == ret.RoutingKey {
+			c.err = fmt.Errorf("%w: %s", Unroutable, ret.ReplyText)
+			return
+		}
+	}
+}
+
+// pop removes the oldest payload, returning why it failed unless acked.
+func (u *unconfirmed) pop(ack bool) (*Payload, error) {
+	if len(*u) == 0 {
+		return nil, nil
+	}
+	c := (*u)[0]
+	*u = (*u)[1:]
+
+	if c.err == nil && !ack {
+		c.err = fmt.Errorf("%w: nacked by broker", PublishFailed)
+	}
+	return c.pl, c.err
+}
+
+// fail settles every payload still awaiting confirmation.
+func (u *unconfirmed) fail(r *Rabbit, err error) {
+	for _, c := range *u {
+		if c.err != nil {
+			r.settle(c.pl, c.err)
+		} else {
+			r.settle(c.pl, err)
+		}
+	}
+	*u = nil
+}
+
+// requeue cancels a consumer and, when waiting for acks, returns any
+// prefetched deliveries that never reached the service to the queue. With
+// MaxAttempts they are published again, as a rejected delivery would be
+// counted as an attempt.
+func (r *Rabbit) requeue(ch *amqp.Channel, c *consumer, d *amqp.Delivery, u *unconfirmed) error {
+	if err := ch.Cancel(c.tag, false); err != nil {
+		return err
+	}
+	if !c.wait {
+		return nil
+	}
+
+	back := func(d *amqp.Delivery) error {
+		if r.desc.MaxAttempts > 0 {
+			return r.publish(ch, forward(Deliver(d), r.desc.Queue), u)
+		}
+		return d.Nack(false, true)
+	}
+	if d != nil {
+		if err := back(d); err != nil {
+			return err
+		}
+	}
+	for d := range c.deliveries {
+		if err := back(&d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publish hands a payload to a channel for publishing.
+func (r *Rabbit) Publish(ctx context.Context, pl *Payload) error {
+	select {
+	case r.out <- pl:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.stop:
+		return ServiceClosed
+	}
+}
+
+// Consume returns the delivered payloads, closed once cancelled.
+func (r *Rabbit) Consume() <-chan *Payload { return r.in }
+
+func (r *Rabbit) Ack(pl *Payload) error { return pl.Ack() }
+
+func (r *Rabbit) Nack(pl *Payload, requeue bool) error { return pl.Nack(requeue) }
+
+// Err returns fatal errors of the connections.
+func (r *Rabbit) Err() <-chan error { return r.errs }
+
+// Cancel stops consuming, returning once no more payloads will be delivered.
+func (r *Rabbit) Cancel() {
+	r.cancelOnce.Do(func() {
+		r.mu.Lock()
+		close(r.cancel)
+		r.mu.Unlock()
+
+		r.consuming.Wait()
+		close(r.in)
+	})
+}
+
+// Close cancels consumers, publishes pending payloads and closes the
+// channels and connection.
+func (r *Rabbit) Close() (err error) {
+	r.Cancel()
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, l := range r.links {
+			if cerr := l.conn.Close(); cerr != amqp.ErrClosed && err == nil {
+				err = cerr
 			}
+		}
+	})
+	return err
+}
 
-		}(); err != nil {
-			log.Println("ERR: ", err)
+// fail reports a fatal error to the service, keeping only the first.
+func (r *Rabbit) fail(err error) {
+	select {
+	case r.errs <- err:
+	default:
+	}
+}
+
+// republishLimit is the number of times a payload without a caller, such as
+// a reply, is republished before it is dropped.
+const republishLimit = 5
+
+// republish hands a reply that failed to publish to another channel after
+// a backoff, dropping it and acking its request once retried too often.
+func (r *Rabbit) republish(pl *Payload) {
+	if pl.retries >= republishLimit {
+		log.Println("dropping", pl.CorId, "to", pl.Route, "after", pl.retries, "retries")
+		if err := pl.Ack(); err != nil {
+			log.Println("ack:", err)
+		}
+		return
+	}
+	delay := backoff(pl.retries)
+	pl.retries++
+
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-r.stop:
+			return
+		}
+		select {
+		case r.out <- pl:
+		case <-r.stop:
 		}
 	}()
-	return nil
 }
 
+// Manage watches every pooled connection and its channels, reopening
+// failed channels and redialing lost connections until the rabbit is
+// stopped.
 func (r *Rabbit) Manage() error {
+	r.mu.Lock()
+	links := r.links
+	r.mu.Unlock()
+
+	errs := make(chan error, len(links))
+	for _, l := range links {
+		r.wg.Add(1)
+		go func(l *link) {
+			defer r.wg.Done()
+			errs <- r.manage(l)
+		}(l)
+	}
+
+	for range links {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+func (r *Rabbit) manage(l *link) error {
+	closed := r.notify(l)
+
+	for {
+		select {
+		case <-r.stop:
+			return nil
+
+		case err, ok := <-closed:
+			if !ok {
+				return nil // closed by us
+			}
+			log.Println("connection closed:", err)
+
+		case lost := <-l.lost:
+			r.mu.Lock()
+			stale := lost.gen != l.gen
+			r.mu.Unlock()
+
+			if stale {
+				continue
+			}
+
+			open := r.open
+			if lost.reply {
+				open = r.openReply
+			}
+			if lost.reply || r.desc.DirectReply {
+				r.dropReply()
+			}
+			if err := open(l); err == nil {
+				continue
+			}
+			log.Println("reopen failed, redialing")
+		}
+
+		if l.reply || r.desc.DirectReply {
+			r.dropReply()
+		}
+
+		r.mu.Lock()
+		l.conn.Close()
+		r.mu.Unlock()
+
+		if err := r.redial(l); err != nil {
+			return err
+		}
+		closed = r.notify(l)
+	}
+}
+
+func (r *Rabbit) notify(l *link) chan *amqp.Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return l.conn.NotifyClose(make(chan *amqp.Error, 1))
+}
+
+const (
+	backoffMin = 100 * time.Millisecond
+	backoffMax = 30 * time.Second
+)
+
+// backoff returns the jittered exponential delay before redial n.
+func backoff(n int) time.Duration {
+	d := backoffMax
+	if n < 16 {
+		if d = backoffMin << uint(n); d > backoffMax {
+			d = backoffMax
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// redial reconnects a link with backoff, redeclaring and consuming on every
+// channel.
+func (r *Rabbit) redial(l *link) error {
+	for n := 0; r.desc.Retries == 0 || n < r.desc.Retries; n++ {
+		select {
+		case <-time.After(backoff(n)):
+		case <-r.stop:
+			return nil
+		}
+
+		if err := r.dial(l); err != nil {
+			log.Println("redial failed:", err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("rabbit: gave up after %d redials", r.desc.Retries)
+}
@@ -1,9 +1,13 @@
 package rrpc
 
 import (
+	"errors"
 	"log"
 	"testing"
 	"time"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
 )
 
 var server = &RabbitDesc{
@@ -32,12 +36,12 @@ func TestConns(t *testing.T) {
 
 	// TODO: Improve starting conditions
 
-	s, err := NewRabbit(server, Conveyor(), Conveyor())
+	s, err := NewRabbit(server)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	c, err := NewRabbit(client, Conveyor(), Conveyor())
+	c, err := NewRabbit(client)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,3 +62,130 @@ func TestConns(t *testing.T) {
 	pl = <-c.in
 	t.Log(time.Now().Sub(start))
 }
+
+func TestBackoff(t *testing.T) {
+	for n := 0; n < 64; n++ {
+		d := backoff(n)
+		if d < backoffMin/2 || d > backoffMax {
+			t.Fatalf("backoff(%d) = %v out of range", n, d)
+		}
+	}
+	if backoff(20) < backoffMax/2 {
+		t.Fatal("backoff not capped at maximum")
+	}
+}
+
+var benchDesc = ServiceDesc{
+	ServiceName: "rabbit-bench",
+	Methods: []MethodDesc{
+		{
+			MethodName: "Echo",
+			Handler: pingHandler("Echo", func(ctx context.Context, req interface{}) (interface{}, error) {
+				return req, nil
+			}),
+		},
+	},
+}
+
+func benchmarkOrder(b *testing.B, direct bool) {
+	srv := NewService()
+	srv.RegisterRabbit(&RabbitDesc{
+		Url:   server.Url,
+		Queue: benchDesc.ServiceName,
+		Wait:  true,
+	})
+	srv.RegisterService(&benchDesc, nil)
+	go srv.Listen()
+	defer srv.Close()
+
+	cli := NewService()
+	cli.RegisterRabbit(&RabbitDesc{
+		Url:         client.Url,
+		DirectReply: direct,
+	})
+	go cli.Listen()
+	defer cli.Close()
+
+	body := []byte(" ／(^ x ^=)＼ ")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		deadline, _ := ctx.Deadline()
+
+		pl := cli.NewPayload(benchDesc.ServiceName, "Echo", TypeServe, deadline, body)
+		if _, err := cli.Order(ctx, pl); err != nil {
+			b.Fatal(err)
+		}
+		cancel()
+	}
+}
+
+func BenchmarkOrder(b *testing.B)       { benchmarkOrder(b, false) }
+func BenchmarkDirectReply(b *testing.B) { benchmarkOrder(b, true) }
+
+func TestUnconfirmed(t *testing.T) {
+	r := &Rabbit{out: Conveyor(), stop: make(chan bool)}
+	u := &unconfirmed{}
+
+	call := &Payload{Route: "PingService", CorId: "call", sent: make(chan error, 1)}
+	unroutable := &Payload{Route: "gone", CorId: "unroutable", sent: make(chan error, 1)}
+	a := &acker{}
+	reply := &Payload{Route: "rabbit-client", CorId: "reply", ack: a}
+	nacked := &Payload{Route: "PingService", CorId: "nacked", sent: make(chan error, 1)}
+
+	for _, pl := range []*Payload{call, unroutable, reply, nacked} {
+		u.push(pl)
+	}
+	u.returned(amqp.Return{ReplyText: "NO_ROUTE", RoutingKey: "gone", CorrelationId: "unroutable"})
+
+	for _, ack := range []bool{true, true, true, false} {
+		pl, err := u.pop(ack)
+		r.settle(pl, err)
+	}
+
+	if err := <-call.sent; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-unroutable.sent; !errors.Is(err, Unroutable) || Convert(callError(err)).Code != Unavailable {
+		t.Fatalf("expected unroutable, got %v", err)
+	}
+	if a.acks != 1 {
+		t.Fatal("confirmed reply not acked")
+	}
+	if err := <-nacked.sent; !errors.Is(err, PublishFailed) {
+		t.Fatalf("expected publish failed, got %v", err)
+	}
+	if pl, _ := u.pop(true); pl != nil {
+		t.Fatalf("unexpected confirmation of %+v", pl)
+	}
+}
+
+func TestRepublish(t *testing.T) {
+	r := &Rabbit{out: Conveyor(), stop: make(chan bool)}
+	defer close(r.stop)
+
+	a := &acker{}
+	reply := &Payload{Route: "rabbit-client", CorId: "reply", ack: a}
+	for i := 0; i < republishLimit; i++ {
+		r.settle(reply, PublishFailed)
+		select {
+		case pl := <-r.out:
+			if pl != reply {
+				t.Fatalf("bad republish: %+v", pl)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("retry %d not republished", i)
+		}
+	}
+
+	r.settle(reply, PublishFailed)
+	if a.acks != 1 {
+		t.Fatal("reply not dropped after the retry limit")
+	}
+	select {
+	case pl := <-r.out:
+		t.Fatalf("republished beyond the limit: %+v", pl)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -2,54 +2,95 @@ package rrpc
 
 import (
 	"errors"
-
-	"golang.org/x/net/context"
+	"sync"
 )
 
 var UnkownRoute = errors.New("unknown route")
 
-/*type Router interface {
-	//Correlate(pl *Payload) // move to something else
-	Handle(pl *Payload) chan *Payload
-	Route(ctx context.Context, pl *Payload) error
+// Router correlates replies with the calls pending them.
+type Router interface {
+	// Register adds a pending call, returning the slot its single reply is
+	// delivered to.
+	Register(cid string) <-chan *Payload
+	// Route delivers a reply to its pending call without blocking, or
+	// returns UnkownRoute.
+	Route(pl *Payload) error
+	// Cancel removes a pending call, dropping any later reply.
+	Cancel(cid string)
 }
 
+const shards = 32
+
+// router is the default Router, a map of pending calls sharded by
+// correlation id so concurrent calls rarely contend.
 type router struct {
-	*sync.Mutex
+	shards [shards]shard
+}
+
+type shard struct {
+	mu    sync.Mutex
 	route map[string]chan *Payload
-	count uint32
 }
-*/
 
-func (s *Service) Handler(cid string) chan *Payload {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// NewRouter returns the default in memory Router.
+func NewRouter() Router {
+	r := &router{}
+	for i := range r.shards {
+		r.shards[i].route = make(map[string]chan *Payload)
+	}
+	return r
+}
+
+func (r *router) shard(cid string) *shard {
+	h := uint32(2166136261) // fnv-1a
+	for i := 0; i < len(cid); i++ {
+		h ^= uint32(cid[i])
+		h *= 16777619
+	}
+	return &r.shards[h%shards]
+}
+
+// pending returns the number of calls awaiting a reply.
+func (r *router) pending() int {
+	n := 0
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.Lock()
+		n += len(sh.route)
+		sh.mu.Unlock()
+	}
+	return n
+}
 
-	/*if p.CorrelationId != "" {
-		if reply, ok := r.route[cid]; ok {
-			return reply
-		}
-	}*/
+func (r *router) Register(cid string) <-chan *Payload {
+	sh := r.shard(cid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	reply := make(chan *Payload)
-	s.route[cid] = reply
+	reply := make(chan *Payload, 1)
+	sh.route[cid] = reply
 	return reply
 }
 
-func (s *Service) Route(ctx context.Context, pl *Payload) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (r *router) Route(pl *Payload) error {
+	sh := r.shard(pl.CorId)
+	sh.mu.Lock()
+	reply, ok := sh.route[pl.CorId]
+	delete(sh.route, pl.CorId)
+	sh.mu.Unlock()
 
-	reply, ok := s.route[pl.CorId]
 	if !ok {
 		return UnkownRoute
 	}
-	delete(s.route, pl.CorId)
 
-	select {
-	case reply <- pl:
-		return nil
-	case <-ctx.Done():
-		return context.DeadlineExceeded
-	}
+	reply <- pl
+	return nil
+}
+
+func (r *router) Cancel(cid string) {
+	sh := r.shard(cid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	delete(sh.route, cid)
 }
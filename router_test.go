@@ -0,0 +1,29 @@
+package rrpc
+
+import (
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+
+	reply := r.Register("a")
+	if err := r.Route(&Payload{CorId: "a", Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if pl := <-reply; string(pl.Body) != "a" {
+		t.Fatalf("bad reply %s", pl.Body)
+	}
+	if err := r.Route(&Payload{CorId: "a"}); err != UnkownRoute {
+		t.Fatalf("expected %v, got %v", UnkownRoute, err)
+	}
+
+	r.Register("b")
+	r.Cancel("b")
+	if err := r.Route(&Payload{CorId: "b"}); err != UnkownRoute {
+		t.Fatalf("expected %v, got %v", UnkownRoute, err)
+	}
+	if n := r.(*router).pending(); n != 0 {
+		t.Fatalf("%d routes not removed", n)
+	}
+}
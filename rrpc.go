@@ -1,17 +1,31 @@
 package rrpc
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
-	//"github.com/streadway/amqp"
+	"github.com/streadway/amqp"
 	"golang.org/x/net/context"
 )
 
-type methodHandler func(srv interface{}, ctx context.Context, b []byte) ([]byte, error)
+var (
+	ServiceClosed = errors.New("service closed")
+	NoTransport   = errors.New("no transport registered")
+	ReplyLost     = errors.New("reply queue lost")
+	PublishFailed = errors.New("publish failed")
+	HandlerPanic  = errors.New("handler panicked")
+	Malformed     = errors.New("malformed request")
+	Unroutable    = errors.New("no queue for route")
+)
+
+type methodHandler func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor UnaryServerInterceptor) (interface{}, error)
 
 type MethodDesc struct {
 	MethodName string
@@ -22,6 +36,7 @@ type ServiceDesc struct {
 	ServiceName string
 	HandlerType interface{}
 	Methods     []MethodDesc
+	Streams     []StreamDesc
 }
 
 type Method struct {
@@ -41,31 +56,164 @@ type Service struct {
 	Version     string    // Program version
 	Compiled    time.Time // Compiled date*/
 
-	methods map[string]*Method
-	//rabbits map[string]*Rabbit
-	rabbit *Rabbit // TODO: multi rabbits
+	methods   map[string]*Method
+	streams   map[string]*streamMethod
+	transport Transport // TODO: multi transports
+
+	streamsMu     *sync.Mutex
+	clientStreams map[string]*stream // streams opened by calls
+	serverStreams map[string]*stream // streams being served
+	window        int                // messages buffered per stream
+	streamBound   time.Duration      // bound of served streams without a deadline
+
+	router  Router // calls pending a reply
+	orphans uint64 // replies without a pending call
 
-	route map[string]chan *Payload
-	count uint32
+	unknown uint64 // requests for unregistered methods
+	expired uint64 // requests dropped past their deadline
+	panics  uint64 // handlers recovered from a panic
+	dead    uint64 // requests moved to the dead letter queue
+
+	deadLetter bool // dead-letter requests whose handler panicked
 
-	in   chan *Payload
-	out  chan *Payload
 	stop chan bool
+
+	interceptors []UnaryServerInterceptor
+	interceptor  UnaryServerInterceptor // chained interceptors
+
+	clientInterceptors []UnaryClientInterceptor
+	clientInterceptor  UnaryClientInterceptor // chained client interceptors
+
+	workers int
+	timeout time.Duration // default call timeout
+	wg      *sync.WaitGroup
+	once    *sync.Once
+	err     error // cause of shutdown
+
+	closing     chan bool // closed once shutdown begins
+	closingOnce *sync.Once
+}
+
+// ServiceOption configures a Service.
+type ServiceOption func(*Service)
+
+// Workers sets the number of workers started by Listen, defaults to the
+// number of cpus or the prefetch of the rabbit, whichever is larger.
+func Workers(n int) ServiceOption {
+	return func(s *Service) {
+		s.workers = n
+	}
+}
+
+// DeadLetterPanics moves requests whose handler panicked to the dead letter
+// queue of the transport instead of acking them. The caller is sent an
+// Internal error either way.
+func DeadLetterPanics(b bool) ServiceOption {
+	return func(s *Service) {
+		s.deadLetter = b
+	}
+}
+
+// DefaultTimeout bounds calls whose context has no deadline.
+const DefaultTimeout = 30 * time.Second
+
+// Timeout sets the timeout of calls whose context has no deadline, defaults
+// to DefaultTimeout, as does a zero or negative timeout.
+func Timeout(d time.Duration) ServiceOption {
+	return func(s *Service) {
+		if d <= 0 {
+			d = DefaultTimeout
+		}
+		s.timeout = d
+	}
+}
+
+// WithRouter sets the Router correlating replies with pending calls,
+// defaults to NewRouter.
+func WithRouter(r Router) ServiceOption {
+	return func(s *Service) {
+		s.router = r
+	}
+}
+
+// CallOption configures a single call.
+type CallOption func(*callInfo)
+
+type callInfo struct {
+	timeout time.Duration
+	headers amqp.Table
+	trailer *MD
+}
+
+// CallTimeout sets the timeout of a call whose context has no deadline,
+// overriding the service default unless zero or negative.
+func CallTimeout(d time.Duration) CallOption {
+	return func(c *callInfo) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// Header sets a header of the outgoing request.
+func Header(key string, value interface{}) CallOption {
+	return func(c *callInfo) {
+		if c.headers == nil {
+			c.headers = amqp.Table{}
+		}
+		c.headers[key] = value
+	}
+}
+
+// Trailer stores the trailer of the reply to a call in md.
+func Trailer(md *MD) CallOption {
+	return func(c *callInfo) {
+		c.trailer = md
+	}
+}
+
+// requestHeaders returns the headers of a request, set by its options and
+// the outgoing metadata of ctx.
+func (c *callInfo) requestHeaders(ctx context.Context) amqp.Table {
+	t := amqp.Table{}
+	for k, v := range c.headers {
+		t[k] = v
+	}
+	if md, ok := FromOutgoingContext(ctx); ok {
+		md.table(t)
+	}
+	return t
 }
 
-func NewService() *Service {
-	return &Service{
+func NewService(opts ...ServiceOption) *Service {
+	s := &Service{
 		mu: &sync.RWMutex{},
 
 		methods: make(map[string]*Method),
-		//rabbits: make(map[string]*Rabbit),
+		streams: make(map[string]*streamMethod),
+
+		streamsMu:     &sync.Mutex{},
+		clientStreams: make(map[string]*stream),
+		serverStreams: make(map[string]*stream),
 
-		route: make(map[string]chan *Payload),
+		router: NewRouter(),
 
-		in:   Conveyor(),
-		out:  Conveyor(),
 		stop: make(chan bool),
+
+		timeout: DefaultTimeout,
+		wg:      &sync.WaitGroup{},
+		once:    &sync.Once{},
+
+		closing:     make(chan bool),
+		closingOnce: &sync.Once{},
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.interceptor = chainUnaryServer(s.interceptors)
+	s.clientInterceptor = chainUnaryClient(s.clientInterceptors)
+	return s
 }
 
 func timeAtCompile() time.Time {
@@ -92,57 +240,144 @@ func (s *Service) RegisterService(sd *ServiceDesc, srv interface{}) {
 		s.methods[md.MethodName] = &Method{md.Handler, srv}
 	}
 
+	for i := range sd.Streams {
+		sd := &sd.Streams[i]
+
+		if _, ok := s.methods[sd.StreamName]; ok {
+			log.Fatalf("duplicate method %s registered", sd.StreamName)
+		}
+		if _, ok := s.streams[sd.StreamName]; ok {
+			log.Fatalf("duplicate method %s registered", sd.StreamName)
+		}
+
+		s.streams[sd.StreamName] = &streamMethod{sd.Handler, srv}
+	}
+
 }
 
-func (s *Service) RegisterRabbit(rd *RabbitDesc) {
-	//s.mu.Lock()
-	//defer s.mu.Unlock()
+// Stats are counters describing the traffic seen by a Service.
+type Stats struct {
+	UnknownMethods uint64 // requests for methods not registered
+	Expired        uint64 // requests dropped past their deadline
+	OrphanReplies  uint64 // replies arriving after their call ended
+	Panics         uint64 // handlers recovered from a panic
+	DeadLettered   uint64 // requests moved to the dead letter queue
+}
 
-	/*if _, ok := s.rabbits[rd.Queue]; ok {
-		log.Fatalf("duplicate queue %s registered", rd.Queue)
-	}*/
-	var err error
-	s.rabbit, err = NewRabbit(rd, s.in, s.out)
+func (s *Service) Stats() Stats {
+	return Stats{
+		UnknownMethods: atomic.LoadUint64(&s.unknown),
+		Expired:        atomic.LoadUint64(&s.expired),
+		OrphanReplies:  atomic.LoadUint64(&s.orphans),
+		Panics:         atomic.LoadUint64(&s.panics),
+		DeadLettered:   atomic.LoadUint64(&s.dead),
+	}
+}
+
+func (s *Service) RegisterRabbit(rd *RabbitDesc) {
+	r, err := NewRabbit(rd)
 	if err != nil {
 		log.Fatal(err)
 	}
+	s.RegisterTransport(r)
+}
+
+// RegisterTransport sets the transport carrying the payloads of the service.
+func (s *Service) RegisterTransport(t Transport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.transport = t
+}
+
+// consume returns the payloads consumed by the transport.
+func (s *Service) consume() <-chan *Payload {
+	if s.transport == nil {
+		return nil
+	}
+	return s.transport.Consume()
 }
 
 func (s *Service) Recieve(ctx context.Context) (*Payload, bool) {
 	select {
-	case b, ok := <-s.in:
+	case b, ok := <-s.consume():
 		return b, ok
 	case <-ctx.Done():
 		return nil, false
 	}
 }
 
-func (s *Service) Send(ctx context.Context, pl *Payload) bool {
+// Send publishes a payload. Requests and stream messages are waited on until
+// published, or confirmed by the broker in confirm mode, failing if they
+// were nacked or unroutable. Others return once handed to the transport.
+func (s *Service) Send(ctx context.Context, pl *Payload) error {
+	if err := s.send(ctx, pl); err != nil || pl.sent == nil {
+		return err
+	}
+
 	select {
-	case s.out <- pl:
-		return true
+	case err := <-pl.sent:
+		return err
+	case <-s.stop:
+		return ServiceClosed
 	case <-ctx.Done():
-		return false
+		return ctx.Err()
 	}
 }
 
-func (s *Service) Order(ctx context.Context, pl *Payload) (*Payload, bool) {
-	reply := s.Handler(pl.CorId)
-
-	if ok := s.Send(ctx, pl); !ok {
-		return nil, false
+// send hands a payload to the transport for publishing.
+func (s *Service) send(ctx context.Context, pl *Payload) error {
+	select {
+	case <-s.stop:
+		return ServiceClosed
+	default:
+	}
+	if s.transport == nil {
+		return NoTransport
 	}
+	return s.transport.Publish(ctx, pl)
+}
 
+// Order sends a request and waits for its reply. It fails with ReplyLost
+// while there is no reply queue.
+func (s *Service) Order(ctx context.Context, pl *Payload) (*Payload, error) {
 	select {
-	case pl, ok := <-reply:
-		return pl, ok
-	case <-ctx.Done():
-		// TODO: Delete route
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		delete(s.route, pl.CorId)
+	case <-s.closing:
+		return nil, ServiceClosed
+	default:
+	}
 
-		return nil, false
+	if pl.Reply == "" {
+		return nil, ReplyLost // no reply queue, being reopened
+	}
+
+	reply := s.router.Register(pl.CorId)
+	defer s.router.Cancel(pl.CorId)
+
+	if err := s.send(ctx, pl); err != nil {
+		return nil, err
+	}
+
+	sent := pl.sent
+	for {
+		select {
+		case pl := <-reply:
+			return pl, nil
+		case err := <-sent:
+			if err == nil {
+				sent = nil // published
+				continue
+			}
+			return nil, err
+		case <-pl.gone:
+			return nil, ReplyLost
+		case <-s.closing:
+			return nil, ServiceClosed
+		case <-s.stop:
+			return nil, s.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
 
@@ -153,84 +388,386 @@ func (s *Service) parse(pl *Payload) error {
 	switch pl.Typ {
 	case TypeServe:
 
+		if pl.Expired() {
+			atomic.AddUint64(&s.expired, 1)
+			return s.transport.Ack(pl) // caller gave up
+		}
+
 		md, ok := s.methods[pl.MsgId]
 		if !ok {
-			return nil // handle
+			atomic.AddUint64(&s.unknown, 1)
+			return s.reply(ctx, pl, nil, &Status{
+				Code:    Unimplemented,
+				Message: fmt.Sprintf("unknown method %s for service %s", pl.MsgId, pl.Route),
+			})
+		}
+
+		if max := s.transport.MaxAttempts(); max > 0 {
+			if pl.Attempts > max {
+				return s.poison(ctx, pl, &Status{
+					Code:    Aborted,
+					Message: fmt.Sprintf("%s abandoned after %d attempts", pl.MsgId, max),
+				})
+			}
+			if pl.Redelivered {
+				// requeue with the count, as the broker may not keep one
+				return s.transport.Requeue(pl)
+			}
 		}
 
-		b, err := md.handler(md.service, ctx, pl.Body)
+		out, err := s.call(ctx, md, pl)
+		if errors.Is(err, Malformed) || errors.Is(err, HandlerPanic) && s.deadLetter {
+			return s.poison(ctx, pl, Convert(err))
+		}
 		if err != nil {
-			return nil // handle
+			return s.reply(ctx, pl, nil, Convert(err))
 		}
 
-		if pl.Reply == "" {
-			break // drop
+		b, err := encode(out)
+		if err != nil {
+			return s.reply(ctx, pl, nil, Convert(err))
 		}
+		return s.reply(ctx, pl, b, nil)
 
-		pl.Route = pl.Reply
-		pl.Reply = ""
-		pl.Typ = TypeReply
-		pl.Body = b
+	case TypeStream:
 
-		if ok := s.Send(ctx, pl); !ok {
-			return nil // handle
+		if pl.MsgId == "" {
+			return s.routeStream(s.serverStreams, pl)
+		}
+		if pl.Expired() {
+			atomic.AddUint64(&s.expired, 1)
+			return s.transport.Ack(pl) // caller gave up
 		}
+		return s.serveStream(pl)
+
+	case TypeStreamReply:
+
+		return s.routeStream(s.clientStreams, pl)
 
 	case TypeReply:
 
-		if err := s.Route(ctx, pl); err != nil {
-			return nil // handle
+		if err := s.transport.Ack(pl); err != nil {
+			return err
+		}
+		if err := s.router.Route(pl); err == UnkownRoute {
+			atomic.AddUint64(&s.orphans, 1)
+		} else if err != nil {
+			return err
 		}
 
 	default:
-		// handle
+		return s.transport.Nack(pl, false)
+	}
+	return nil
+}
+
+// call calls the handler of a method, recovering a panic as an Internal
+// error.
+func (s *Service) call(ctx context.Context, md *Method, pl *Payload) (out interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(pl.MsgId, r)
+		}
+	}()
+	return md.handler(md.service, ctx, decoder(pl.Body), s.interceptor)
+}
+
+// recovered logs the stack of a handler panic, returning it as an Internal
+// error.
+func (s *Service) recovered(method string, r interface{}) error {
+	atomic.AddUint64(&s.panics, 1)
+	log.Printf("panic serving %s: %v\n%s", method, r, debug.Stack())
+
+	return &Status{
+		Code:    Internal,
+		Message: fmt.Sprintf("panic serving %s: %v", method, r),
+		err:     HandlerPanic,
+	}
+}
+
+// decoder returns the function handlers decode their request with.
+func decoder(b []byte) func(interface{}) error {
+	return func(v interface{}) error {
+		pb, ok := v.(proto.Message)
+		if !ok {
+			return Errorf(Internal, "request %T is not a proto.Message", v)
+		}
+		if err := Dec(b, pb); err != nil {
+			return &Status{
+				Code:    InvalidArgument,
+				Message: fmt.Sprintf("decoding request: %v", err),
+				err:     Malformed,
+			}
+		}
+		return nil
+	}
+}
+
+// encode encodes the response of a handler.
+func encode(v interface{}) ([]byte, error) {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return nil, Errorf(Internal, "response %T is not a proto.Message", v)
+	}
+	b, err := Enc(pb)
+	if err != nil {
+		return nil, Errorf(Internal, "encoding response: %v", err)
+	}
+	return b, nil
+}
+
+// poison moves a request that cannot be served to the dead letter queue,
+// replying with its status.
+func (s *Service) poison(ctx context.Context, pl *Payload, st *Status) error {
+	atomic.AddUint64(&s.dead, 1)
+	if err := s.transport.DeadLetter(pl, st); err != nil {
+		return err
+	}
+	return s.reply(ctx, pl, nil, st)
+}
+
+// reply sends the result of a served payload back to the caller. The request
+// is acknowledged once the reply is published, or straight away if no reply
+// is wanted.
+func (s *Service) reply(ctx context.Context, pl *Payload, b []byte, st *Status) error {
+	if pl.Reply == "" {
+		return s.transport.Ack(pl) // drop
+	}
+	req := *pl // requeued if the reply is not sent
+
+	pl.Route = pl.Reply
+	pl.Reply = ""
+	pl.Typ = TypeReply
+	pl.Headers = nil
+	pl.Body = b
+	pl.Status = st
+
+	if md := trailerFromContext(ctx); len(md) > 0 {
+		pl.Headers = amqp.Table{}
+		md.table(pl.Headers)
+	}
+
+	if err := s.Send(ctx, pl); err != nil {
+		// requeue unless the caller has given up
+		var nerr error
+		if ctx.Err() == nil {
+			nerr = s.transport.Requeue(&req)
+		} else {
+			nerr = s.transport.Nack(pl, false)
+		}
+		if nerr != nil {
+			return nerr
+		}
+		return err
 	}
 	return nil
 }
 
 func (s *Service) worker() {
-	for pl := range s.in {
+	defer s.wg.Done()
 
+	for {
 		select {
 		case <-s.stop:
-			// s.out <- pump message out
 			return
-		default:
+
+		case pl, ok := <-s.consume():
+			if !ok {
+				return
+			}
 			if err := s.parse(pl); err != nil {
 				log.Println(err) // handle
 			}
 		}
+	}
+}
+
+// callContext applies the call options, bounding ctx by the call timeout
+// unless it has a deadline.
+func (s *Service) callContext(ctx context.Context, opts []CallOption) (context.Context, context.CancelFunc, *callInfo) {
+	c := &callInfo{timeout: s.timeout}
+	for _, opt := range opts {
+		opt(c)
+	}
 
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}, c
 	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	return ctx, cancel, c
 }
 
 // Invoke is called by generated rrpc code.
-func (s *Service) Invoke(ctx context.Context, queue, message string, in, out proto.Message) error {
+func (s *Service) Invoke(ctx context.Context, queue, message string, in, out proto.Message, opts ...CallOption) error {
+	if s.clientInterceptor == nil {
+		return s.invoke(ctx, queue, message, in, out, opts...)
+	}
+	return s.clientInterceptor(ctx, queue, message, in, out, s.invoke, opts...)
+}
+
+func (s *Service) invoke(ctx context.Context, queue, message string, in, out proto.Message, opts ...CallOption) error {
+	ctx, cancel, c := s.callContext(ctx, opts)
+	defer cancel()
 
 	b, err := Enc(in)
 	if err != nil {
 		return err
 	}
 
-	deadline, ok := ctx.Deadline()
-	if !ok {
-		return context.DeadlineExceeded
+	deadline, _ := ctx.Deadline()
+	pl := s.NewPayload(queue, message, TypeServe, deadline, b)
+	pl.Headers = c.requestHeaders(ctx)
+
+	pl, err = s.Order(ctx, pl)
+	if err != nil {
+		return callError(err)
 	}
 
-	pl, ok := s.Order(ctx, s.NewPayload(queue, message, TypeServe, deadline, b))
-	if !ok {
-		return nil // something
+	if c.trailer != nil {
+		*c.trailer = tableMD(pl.Headers)
 	}
 
+	if pl.Status != nil {
+		return pl.Status
+	}
 	return Dec(pl.Body, out)
 }
 
-func (s *Service) Listen() error {
+// Notify is called by generated rrpc code for one-way methods. The request
+// is sent without a reply queue, returning once it is published. It expires
+// only with the deadline of ctx, the call timeout bounding the publish.
+func (s *Service) Notify(ctx context.Context, queue, message string, in proto.Message, opts ...CallOption) error {
+	if s.clientInterceptor == nil {
+		return s.notify(ctx, queue, message, in, nil, opts...)
+	}
+	return s.clientInterceptor(ctx, queue, message, in, nil, s.notify, opts...)
+}
+
+func (s *Service) notify(ctx context.Context, queue, message string, in, _ proto.Message, opts ...CallOption) error {
+	deadline, _ := ctx.Deadline() // the request expires only if the caller set one
+	ctx, cancel, c := s.callContext(ctx, opts)
+	defer cancel()
+
+	b, err := Enc(in)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-s.closing:
+		return callError(ServiceClosed)
+	default:
+	}
+
+	pl := s.NewPayload(queue, message, TypeServe, deadline, b)
+	pl.Reply = "" // one-way
+	pl.gone = nil
+	pl.Headers = c.requestHeaders(ctx)
+
+	if err := s.Send(ctx, pl); err != nil {
+		return callError(err)
+	}
 	return nil
 }
 
+// Listen starts the workers and blocks until the service is stopped,
+// returning the error that caused it.
+func (s *Service) Listen() error {
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+		s.mu.Unlock()
+		return ServiceClosed
+	default:
+	}
+
+	for i := 0; i < s.concurrency(); i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	s.mu.Unlock()
+
+	var errs <-chan error
+	if s.transport != nil {
+		errs = s.transport.Err()
+	}
+
+	select {
+	case err := <-errs:
+		s.shutdown(err)
+	case <-s.stop:
+	}
+
+	s.wg.Wait()
+	return s.err
+}
+
+// concurrency is the number of workers to start.
+func (s *Service) concurrency() int {
+	if s.workers > 0 {
+		return s.workers
+	}
+	if s.transport != nil && s.transport.Inflight() > cpus {
+		return s.transport.Inflight()
+	}
+	return cpus
+}
+
+// shutdown stops the service, recording the first cause.
+func (s *Service) shutdown(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.stop)
+	})
+}
+
+// Shutdown gracefully stops the service. Consuming stops, pending calls and
+// client streams fail with ServiceClosed, served streams are cancelled and
+// in-flight handlers are drained until ctx is done, before the transport is
+// closed.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.closingOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closing)
+		s.mu.Unlock()
+
+		if s.transport != nil {
+			s.cancelStreams()
+			s.transport.Cancel()
+		}
+	})
+
+	drained := make(chan bool)
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.shutdown(ServiceClosed)
+
+	// requeue anything the workers never picked up
+	if s.transport != nil {
+		for pl := range s.transport.Consume() {
+			s.transport.Requeue(pl)
+		}
+		if cerr := s.transport.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Close stops the service without waiting for in-flight handlers.
 func (s *Service) Close() {
-	// Kill the service, drain gracefully
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-	// kill all the workers
+	s.Shutdown(ctx)
 }
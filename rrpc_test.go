@@ -1,9 +1,625 @@
 package rrpc
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
-func TestService() {
+func TestService(t *testing.T) {
+
+}
+
+// memoryService returns a service consuming queue on a new Memory broker,
+// or a client only service if queue is empty.
+func memoryService(queue string, opts ...ServiceOption) (*Service, *Memory) {
+	m := NewMemory()
+	s := NewService(opts...)
+	s.RegisterTransport(m.Transport(queue))
+	return s, m
+}
+
+// memoryServices returns a server of desc and a client on a new Memory
+// broker, both listening until closed.
+func memoryServices(desc *ServiceDesc, srvOpts, cliOpts []ServiceOption) (srv, cli *Service) {
+	m := NewMemory()
+
+	srv = NewService(srvOpts...)
+	srv.RegisterService(desc, nil)
+	srv.RegisterTransport(m.Transport(desc.ServiceName))
+	go srv.Listen()
+
+	cli = NewService(cliOpts...)
+	cli.RegisterTransport(m.Transport(""))
+	go cli.Listen()
+	return srv, cli
+}
+
+// answer publishes the reply to a request on the broker.
+func answer(m *Memory, pl *Payload, st *Status) error {
+	t := m.Transport("")
+	defer t.Close()
+
+	pl.Route = pl.Reply
+	pl.Reply = ""
+	pl.Typ = TypeReply
+	pl.Status = st
+	return t.Publish(context.Background(), pl)
+}
+
+func TestUnknownMethod(t *testing.T) {
+	s, m := memoryService("PingService")
+
+	pl := &Payload{
+		Route: "PingService",
+		Reply: "rabbit-client",
+		Exp:   time.Now().Add(time.Second),
+		Typ:   TypeServe,
+		MsgId: "Pong",
+	}
+	if err := s.parse(pl); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := <-m.queue("rabbit-client")
+	if reply.Route != "rabbit-client" || reply.Typ != TypeReply {
+		t.Fatalf("bad reply: %+v", reply)
+	}
+	if reply.Status == nil || reply.Status.Code != Unimplemented {
+		t.Fatalf("expected unimplemented, got %v", reply.Status)
+	}
+	if n := s.Stats().UnknownMethods; n != 1 {
+		t.Fatalf("expected 1 unknown method, got %d", n)
+	}
+}
+
+func TestListen(t *testing.T) {
+	s, m := memoryService("PingService", Workers(2))
+
+	done := make(chan error)
+	go func() { done <- s.Listen() }()
+
+	m.queue("PingService") <- &Payload{
+		Route: "PingService",
+		Reply: "rabbit-client",
+		Exp:   time.Now().Add(time.Second),
+		Typ:   TypeServe,
+		MsgId: "Pong",
+	}
+	if reply := <-m.queue("rabbit-client"); reply.Typ != TypeReply {
+		t.Fatalf("bad reply: %+v", reply)
+	}
+
+	s.Close()
+	if err := <-done; err != ServiceClosed {
+		t.Fatalf("expected %v, got %v", ServiceClosed, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, m := memoryService("")
+
+	done := make(chan error)
+	go func() { done <- s.Listen() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	pending := make(chan error)
+	go func() {
+		_, err := s.Order(ctx, &Payload{Route: "PingService", Reply: "rabbit-client", CorId: "pending", Typ: TypeServe})
+		pending <- err
+	}()
+	<-m.queue("PingService") // published, awaiting a reply
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-pending; err != ServiceClosed {
+		t.Fatalf("expected %v, got %v", ServiceClosed, err)
+	}
+	if err := <-done; err != ServiceClosed {
+		t.Fatalf("expected %v, got %v", ServiceClosed, err)
+	}
+	if _, err := s.Order(ctx, &Payload{CorId: "late"}); err != ServiceClosed {
+		t.Fatalf("expected %v, got %v", ServiceClosed, err)
+	}
+	if err := s.Invoke(ctx, "PingService", "Ping", &empty{}, &empty{}); !errors.Is(err, ServiceClosed) || Convert(err).Code != Unavailable {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+}
+
+// empty is a message without fields.
+type empty struct{}
+
+func (*empty) Reset()         {}
+func (*empty) String() string { return "" }
+func (*empty) ProtoMessage()  {}
+
+// acker records acknowledgements of fake deliveries.
+type acker struct {
+	acks, nacks int
+}
+
+func (a *acker) Ack(tag uint64, multiple bool) error                { a.acks++; return nil }
+func (a *acker) Nack(tag uint64, multiple bool, requeue bool) error { a.nacks++; return nil }
+func (a *acker) Reject(tag uint64, requeue bool) error              { a.nacks++; return nil }
+
+func TestAckAfterReply(t *testing.T) {
+	s, m := memoryService("PingService")
+	a := &acker{}
+
+	pl := &Payload{
+		Route: "PingService",
+		Reply: "rabbit-client",
+		Exp:   time.Now().Add(time.Second),
+		Typ:   TypeServe,
+		MsgId: "Pong",
+		Tag:   1,
+		ack:   a,
+	}
+	if err := s.parse(pl); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-m.queue("rabbit-client"):
+	default:
+		t.Fatal("reply not published")
+	}
+	if a.acks != 1 || a.nacks != 0 {
+		t.Fatalf("expected a single ack, got %+v", a)
+	}
+
+	pl = &Payload{Exp: time.Now().Add(time.Second), Typ: TypeServe, MsgId: "Pong", ack: a}
+	if err := s.parse(pl); err != nil {
+		t.Fatal(err)
+	}
+	if a.acks != 2 {
+		t.Fatal("request without reply not acked")
+	}
+}
+
+func TestReplyLost(t *testing.T) {
+	s, _ := memoryService("")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	gone := make(chan bool)
+	close(gone)
+
+	if _, err := s.Order(ctx, &Payload{Reply: "rabbit-client", CorId: "lost", gone: gone}); err != ReplyLost {
+		t.Fatalf("expected %v, got %v", ReplyLost, err)
+	}
+	if n := s.router.(*router).pending(); n != 0 {
+		t.Fatalf("%d routes not removed", n)
+	}
+}
+
+// noReplyTransport is a transport whose reply queue is being reopened.
+type noReplyTransport struct{ Transport }
+
+func (noReplyTransport) ReplyTo() (string, <-chan bool) { return "", nil }
+
+func TestNoReplyQueue(t *testing.T) {
+	m := NewMemory()
+	s := NewService(Timeout(time.Minute))
+	s.RegisterTransport(noReplyTransport{m.Transport("")})
+	defer s.Close()
+
+	ctx := context.Background()
+	if err := s.Invoke(ctx, "PingService", "Ping", &empty{}, &empty{}); !errors.Is(err, ReplyLost) || Convert(err).Code != Unavailable {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+	if _, err := s.NewStream(ctx, &StreamDesc{ServerStreams: true}, "PingService", "Watch"); !errors.Is(err, ReplyLost) {
+		t.Fatalf("expected %v, got %v", ReplyLost, err)
+	}
+	if n := len(m.queue("PingService")); n != 0 {
+		t.Fatalf("published %d requests without a reply queue", n)
+	}
+
+	if err := s.Notify(ctx, "PingService", "Ping", &empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.queue("PingService")); n != 1 {
+		t.Fatalf("expected the one-way request, got %d", n)
+	}
+}
+
+// nackTransport is a transport whose broker nacks every publish.
+type nackTransport struct{ Transport }
+
+func (nackTransport) Publish(ctx context.Context, pl *Payload) error {
+	if pl.sent != nil {
+		pl.sent <- PublishFailed
+	}
+	return nil
+}
+
+func TestSendNacked(t *testing.T) {
+	m := NewMemory()
+	s := NewService()
+	s.RegisterTransport(nackTransport{m.Transport("")})
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	pl := s.NewPayload("PingService", "Ping", TypeServe, time.Time{}, nil)
+	if err := s.Send(ctx, pl); err != PublishFailed {
+		t.Fatalf("expected %v, got %v", PublishFailed, err)
+	}
+	if err := s.Send(ctx, &Payload{Route: "PingService"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	s, m := memoryService("", Workers(4))
+	go s.Listen()
+	defer s.Close()
+
+	const calls = 64
+
+	// echo every request back, in reverse order
+	go func() {
+		var requests []*Payload
+		for len(requests) < calls {
+			requests = append(requests, <-m.queue("PingService"))
+		}
+		for i := len(requests) - 1; i >= 0; i-- {
+			answer(m, requests[i], nil)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func(i int) {
+			body := fmt.Sprint(i)
+			reply, err := s.Order(ctx, s.NewPayload("PingService", "Ping", TypeServe, deadline, []byte(body)))
+			if err == nil && string(reply.Body) != body {
+				err = fmt.Errorf("call %s got reply %s", body, reply.Body)
+			}
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < calls; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s, m := memoryService("PingService")
+	a := &acker{}
+
+	pl := &Payload{
+		Route: "PingService",
+		Reply: "rabbit-client",
+		Exp:   time.Now().Add(-time.Second),
+		Typ:   TypeServe,
+		MsgId: "Ping",
+		ack:   a,
+	}
+	if err := s.parse(pl); err != nil {
+		t.Fatal(err)
+	}
+	if a.acks != 1 {
+		t.Fatal("expired request not acked")
+	}
+	if n := s.Stats().Expired; n != 1 {
+		t.Fatalf("expected 1 expired request, got %d", n)
+	}
+	select {
+	case reply := <-m.queue("rabbit-client"):
+		t.Fatalf("unexpected reply: %+v", reply)
+	default:
+	}
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	for _, c := range []struct {
+		timeout, call, want time.Duration
+	}{
+		{time.Minute, time.Second, time.Second},
+		{time.Minute, 0, time.Minute},
+		{0, -time.Second, DefaultTimeout},
+	} {
+		s := NewService(Timeout(c.timeout))
+
+		ctx, cancel, _ := s.callContext(context.Background(), []CallOption{CallTimeout(c.call)})
+		deadline, ok := ctx.Deadline()
+		if left := time.Until(deadline); !ok || left <= c.want-time.Second || left > c.want {
+			t.Fatalf("expected a deadline in %v, %v left", c.want, left)
+		}
+		cancel()
+	}
+
+	bound, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	s := NewService()
+	if ctx, _, _ := s.callContext(bound, nil); ctx != bound {
+		t.Fatal("deadline of the context overridden")
+	}
+}
+
+func TestRouteCleanup(t *testing.T) {
+	s, _ := memoryService("")
+	s.shutdown(ServiceClosed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := s.Order(ctx, &Payload{Reply: "rabbit-client", CorId: "unsent"}); err != ServiceClosed {
+		t.Fatalf("expected %v, got %v", ServiceClosed, err)
+	}
+	if n := s.router.(*router).pending(); n != 0 {
+		t.Fatalf("%d routes not removed", n)
+	}
+
+	if err := s.parse(&Payload{CorId: "unsent", Typ: TypeReply}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Stats().OrphanReplies; n != 1 {
+		t.Fatalf("expected 1 orphan reply, got %d", n)
+	}
+}
+
+func TestInvokeDeadline(t *testing.T) {
+	s, _ := memoryService("")
+	go s.Listen()
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := s.Invoke(ctx, "PingService", "Ping", &empty{}, &empty{})
+	if !errors.Is(err, context.DeadlineExceeded) || Convert(err).Code != DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	panicDesc := &ServiceDesc{
+		ServiceName: "PingService",
+		Methods: []MethodDesc{
+			{
+				MethodName: "Panic",
+				Handler: pingHandler("Panic", func(ctx context.Context, req interface{}) (interface{}, error) {
+					panic("boom")
+				}),
+			},
+		},
+	}
+
+	for _, deadLetter := range []bool{false, true} {
+		s, m := memoryService("PingService", DeadLetterPanics(deadLetter))
+		s.RegisterService(panicDesc, nil)
+		a := &acker{}
+
+		pl := &Payload{
+			Route: "PingService",
+			Reply: "rabbit-client",
+			Exp:   time.Now().Add(time.Second),
+			Typ:   TypeServe,
+			MsgId: "Panic",
+			ack:   a,
+		}
+		if err := s.parse(pl); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := <-m.queue("rabbit-client")
+		if reply.Status == nil || reply.Status.Code != Internal {
+			t.Fatalf("expected internal, got %v", reply.Status)
+		}
+		if a.acks != 1 || a.nacks != 0 {
+			t.Fatalf("expected a single ack, got %+v", a)
+		}
+		if n := len(m.queue("PingService.dlq")); deadLetter && n != 1 || !deadLetter && n != 0 {
+			t.Fatalf("dead-lettered %d requests", n)
+		}
+		if n := s.Stats().Panics; n != 1 {
+			t.Fatalf("expected 1 panic, got %d", n)
+		}
+	}
+}
+
+// attemptsTransport limits the deliveries of requests on a transport.
+type attemptsTransport struct {
+	Transport
+	max int
+}
+
+func (t attemptsTransport) MaxAttempts() int { return t.max }
+
+func TestDeadLetter(t *testing.T) {
+	m := NewMemory()
+	s := NewService()
+	s.RegisterService(pingDesc, nil)
+	s.RegisterTransport(attemptsTransport{m.Transport("PingService"), 3})
+
+	for _, c := range []struct {
+		name     string
+		body     []byte
+		attempts int
+		code     Code
+	}{
+		{"malformed", []byte{0xff}, 1, InvalidArgument}, // truncated varint
+		{"abandoned", nil, 4, Aborted},
+	} {
+		a := &acker{}
+		pl := &Payload{
+			Route:    "PingService",
+			Reply:    "rabbit-client",
+			Exp:      time.Now().Add(time.Second),
+			Typ:      TypeServe,
+			MsgId:    "Ping",
+			Body:     c.body,
+			Attempts: c.attempts,
+			ack:      a,
+		}
+		if err := s.parse(pl); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := <-m.queue("rabbit-client")
+		if reply.Status == nil || reply.Status.Code != c.code {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.code, reply.Status)
+		}
+		if a.acks != 1 || a.nacks != 0 {
+			t.Fatalf("%s: expected a single ack, got %+v", c.name, a)
+		}
+
+		dl := <-m.queue("PingService.dlq")
+		if dl.MsgId != "Ping" || dl.Headers[headerQueue] != "PingService" {
+			t.Fatalf("%s: bad dead letter %+v", c.name, dl)
+		}
+		if reason, _ := dl.Headers[headerError].(string); reason == "" {
+			t.Fatalf("%s: dead letter without a reason", c.name)
+		}
+		if dl.Attempts != c.attempts {
+			t.Fatalf("%s: expected %d attempts, got %d", c.name, c.attempts, dl.Attempts)
+		}
+	}
+	if n := s.Stats().DeadLettered; n != 2 {
+		t.Fatalf("expected 2 dead-lettered requests, got %d", n)
+	}
+}
+
+func TestRedelivered(t *testing.T) {
+	m := NewMemory()
+	s := NewService()
+	s.RegisterService(pingDesc, nil)
+	s.RegisterTransport(attemptsTransport{m.Transport("PingService"), 3})
+
+	tr := m.Transport("")
+	defer tr.Close()
+	if err := tr.Publish(context.Background(), &Payload{
+		Route: "PingService",
+		Reply: "rabbit-client",
+		Exp:   time.Now().Add(time.Second),
+		Typ:   TypeServe,
+		MsgId: "Ping",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the consumer dies serving every delivery
+	for attempts := 1; attempts <= 3; attempts++ {
+		pl := <-m.queue("PingService")
+		if pl.Attempts != attempts {
+			t.Fatalf("expected attempt %d, got %d", attempts, pl.Attempts)
+		}
+		if err := pl.Nack(true); err != nil {
+			t.Fatal(err)
+		}
+
+		pl = <-m.queue("PingService")
+		if err := s.parse(pl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply := <-m.queue("rabbit-client")
+	if reply.Status == nil || reply.Status.Code != Aborted {
+		t.Fatalf("expected aborted, got %v", reply.Status)
+	}
+	if dl := <-m.queue("PingService.dlq"); dl.Attempts != 4 {
+		t.Fatalf("expected 4 attempts, got %d", dl.Attempts)
+	}
+	if n := len(m.queue("PingService")); n != 0 {
+		t.Fatalf("%d requests left", n)
+	}
+}
+
+func TestShutdownRequeue(t *testing.T) {
+	m := NewMemory()
+	s := NewService()
+	s.RegisterService(pingDesc, nil)
+	s.RegisterTransport(attemptsTransport{m.Transport("PingService"), 3})
+
+	tr := m.Transport("")
+	defer tr.Close()
+	if err := tr.Publish(context.Background(), &Payload{
+		Route: "PingService",
+		Reply: "rabbit-client",
+		Typ:   TypeServe,
+		MsgId: "Ping",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for len(m.queue("PingService")) != 0 {
+		time.Sleep(time.Millisecond) // consumed, never served
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pl := <-m.queue("PingService"):
+		if pl.Attempts != 1 {
+			t.Fatalf("requeue counted as an attempt, got %d", pl.Attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not requeued")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	release := make(chan bool)
+	served := make(chan bool, 1)
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Methods: []MethodDesc{
+			{
+				MethodName: "Ping",
+				Handler: pingHandler("Ping", func(ctx context.Context, req interface{}) (interface{}, error) {
+					<-release
+					served <- true
+					return req, nil
+				}),
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// sent without a reply queue, expiring only with a deadline
+	s, m := memoryService("")
+	defer s.Close()
+	if err := s.Notify(context.Background(), "PingService", "Ping", &empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if pl := <-m.queue("PingService"); pl.Reply != "" || !pl.Exp.IsZero() {
+		t.Fatalf("one-way request with reply queue %q, deadline %v", pl.Reply, pl.Exp)
+	}
+	if err := s.Notify(ctx, "PingService", "Ping", &empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if pl := <-m.queue("PingService"); pl.Exp.IsZero() {
+		t.Fatal("one-way request without the deadline of its context")
+	}
 
+	// returns once published, before it is served
+	srv, cli := memoryServices(desc, nil, nil)
+	defer srv.Close()
+	defer cli.Close()
+	if err := cli.Notify(ctx, "PingService", "Ping", &empty{}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-served
 }
@@ -0,0 +1,154 @@
+package rrpc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+// Code is the status code of a reply, following the gRPC codes.
+type Code uint32
+
+const (
+	OK Code = iota
+	Canceled
+	Unknown
+	InvalidArgument
+	DeadlineExceeded
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	Unimplemented
+	Internal
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// Status is the error carried back to the caller in a reply.
+type Status struct {
+	Code    Code
+	Message string
+	Details []byte
+
+	err error // local cause
+}
+
+func (st *Status) Error() string {
+	return fmt.Sprintf("rrpc: code = %s desc = %s", st.Code, st.Message)
+}
+
+// Unwrap returns the local cause of a failed call, such as
+// context.DeadlineExceeded, for errors.Is.
+func (st *Status) Unwrap() error { return st.err }
+
+// Errorf returns a *Status error, or nil if c is OK.
+func Errorf(c Code, format string, a ...interface{}) error {
+	if c == OK {
+		return nil
+	}
+	return &Status{Code: c, Message: fmt.Sprintf(format, a...)}
+}
+
+// Convert returns the *Status for err, wrapping foreign errors as Unknown.
+func Convert(err error) *Status {
+	if err == nil {
+		return nil
+	}
+	var st *Status
+	if errors.As(err, &st) {
+		return st
+	}
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// callError converts the error failing a call into a *Status, keeping the
+// cause.
+func callError(err error) error {
+	var st *Status
+	if errors.As(err, &st) {
+		return err
+	}
+
+	c := Unknown
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		c = DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		c = Canceled
+	case errors.Is(err, ServiceClosed), errors.Is(err, ReplyLost),
+		errors.Is(err, PublishFailed), errors.Is(err, Unroutable):
+		c = Unavailable
+	}
+	return &Status{Code: c, Message: err.Error(), err: err}
+}
+
+const (
+	headerCode    = "rrpc-code"
+	headerMessage = "rrpc-message"
+	headerDetails = "rrpc-details"
+)
+
+func (st *Status) table(t amqp.Table) {
+	t[headerCode] = int64(st.Code)
+	t[headerMessage] = st.Message
+	if len(st.Details) > 0 {
+		t[headerDetails] = st.Details
+	}
+}
+
+func tableStatus(t amqp.Table) *Status {
+	v, ok := t[headerCode]
+	if !ok {
+		return nil
+	}
+
+	st := &Status{}
+	switch c := v.(type) {
+	case int64:
+		st.Code = Code(c)
+	case int32:
+		st.Code = Code(c)
+	case int16:
+		st.Code = Code(c)
+	default:
+		st.Code = Unknown
+	}
+	st.Message, _ = t[headerMessage].(string)
+	st.Details, _ = t[headerDetails].([]byte)
+	return st
+}
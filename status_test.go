@@ -0,0 +1,73 @@
+package rrpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+func TestStatusHeaders(t *testing.T) {
+	pl := &Payload{
+		Typ:    TypeReply,
+		Status: &Status{Code: NotFound, Message: "no such ping", Details: []byte{1, 2}},
+	}
+
+	p := pl.Publish()
+	got := Deliver(&amqp.Delivery{Headers: p.Headers, Type: p.Type})
+
+	if got.Status == nil {
+		t.Fatal("status not delivered")
+	}
+	if got.Status.Code != NotFound || got.Status.Message != "no such ping" || len(got.Status.Details) != 2 {
+		t.Fatalf("status mismatch: %+v", got.Status)
+	}
+
+	if got = Deliver(&amqp.Delivery{}); got.Status != nil {
+		t.Fatalf("unexpected status: %+v", got.Status)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	if st := Convert(nil); st != nil {
+		t.Fatalf("expected nil, got %v", st)
+	}
+	if st := Convert(errors.New("boom")); st.Code != Unknown || st.Message != "boom" {
+		t.Fatalf("expected unknown, got %v", st)
+	}
+	if st := Convert(Errorf(InvalidArgument, "bad %d", 1)); st.Code != InvalidArgument || st.Message != "bad 1" {
+		t.Fatalf("expected invalid argument, got %v", st)
+	}
+	if err := Errorf(OK, "fine"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code Code
+	}{
+		{context.DeadlineExceeded, DeadlineExceeded},
+		{context.Canceled, Canceled},
+		{ServiceClosed, Unavailable},
+		{ReplyLost, Unavailable},
+		{fmt.Errorf("%w: no route", PublishFailed), Unavailable},
+		{errors.New("boom"), Unknown},
+	} {
+		err := callError(test.err)
+		if st := Convert(err); st.Code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.err, test.code, st.Code)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: cause lost", test.err)
+		}
+	}
+
+	st := &Status{Code: NotFound}
+	if err := callError(st); err != st {
+		t.Fatalf("expected status unchanged, got %v", err)
+	}
+}
@@ -0,0 +1,600 @@
+package rrpc
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+const (
+	TypeStream      string = "stream"       // to the server of a stream
+	TypeStreamReply string = "stream-reply" // to the client of a stream
+)
+
+const (
+	headerSeq    = "rrpc-seq"    // order of a message in its stream
+	headerEOS    = "rrpc-eos"    // last message of the sender
+	headerCredit = "rrpc-credit" // further messages the receiver has room for
+	headerCancel = "rrpc-cancel" // the client gave up
+)
+
+// DefaultWindow is the number of messages a stream buffers ahead of its
+// reader.
+const DefaultWindow = 64
+
+// StreamWindow sets the number of messages a stream buffers ahead of its
+// reader, defaults to DefaultWindow. Senders block until the reader makes
+// room.
+func StreamWindow(n int) ServiceOption {
+	return func(s *Service) {
+		s.window = n
+	}
+}
+
+// DefaultStreamTimeout bounds served streams whose client set no deadline,
+// so a client that went away without cancelling does not hold its handler
+// forever.
+const DefaultStreamTimeout = 10 * time.Minute
+
+// StreamTimeout sets the bound of served streams whose client set no
+// deadline, defaults to DefaultStreamTimeout, as does a zero or negative
+// timeout.
+func StreamTimeout(d time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.streamBound = d
+	}
+}
+
+// StreamHandler serves a stream, returning its status.
+type StreamHandler func(srv interface{}, stream ServerStream) error
+
+type streamMethod struct {
+	handler StreamHandler
+	service interface{}
+}
+
+type StreamDesc struct {
+	StreamName    string
+	Handler       StreamHandler
+	ServerStreams bool
+	ClientStreams bool
+}
+
+// Stream is the common interface of both ends of a stream.
+type Stream interface {
+	// Context returns the context of the stream, done once it is cancelled.
+	Context() context.Context
+	// SendMsg sends a message, blocking until the peer has room for it.
+	SendMsg(m interface{}) error
+	// RecvMsg receives the next message, returning io.EOF once the peer
+	// has sent its last.
+	RecvMsg(m interface{}) error
+}
+
+// ClientStream is the client end of a stream, created by NewStream.
+type ClientStream interface {
+	Stream
+	// CloseSend tells the server no more messages are sent.
+	CloseSend() error
+	// Trailer returns the trailer of the server, once RecvMsg has
+	// returned an error.
+	Trailer() MD
+}
+
+// ServerStream is the server end of a stream, passed to its handler.
+type ServerStream interface {
+	Stream
+	// SetTrailer adds metadata sent once the handler returns.
+	SetTrailer(md MD)
+}
+
+// stream is an end of a stream. Messages carry sequence numbers, as they
+// may be published on different channels, and are reordered on receipt.
+// A sender is granted credit by the receiver for each message read.
+type stream struct {
+	s      *Service
+	ctx    context.Context
+	cancel context.CancelFunc
+	id     string
+	typ    string // type of the messages sent
+	client bool
+	method string      // served method
+	gone   <-chan bool // reply queue lost
+
+	queue   string      // served queue a client stream was opened on
+	closing <-chan bool // closed once the client service shuts down
+
+	mu       *sync.Mutex
+	route    string // queue of the peer, empty until it is known
+	seq      int64  // sequence number of the next message sent
+	credit   int64  // messages the peer has room for
+	closed   bool   // last message sent
+	credited chan bool
+
+	cancelled bool // the server was told the client gave up
+
+	next    int64              // sequence number of the next message read
+	arrived int64              // sequence number of the next message to arrive
+	pending map[int64]*Payload // arrived, not yet read
+	read    int64              // messages read since credit was granted
+	ready   chan bool
+	err     error // end of the messages read
+	trailer MD
+
+	done     chan bool // closed once the stream is finished
+	doneOnce *sync.Once
+}
+
+func (s *Service) newStream(ctx context.Context, cancel context.CancelFunc, id, typ string) *stream {
+	return &stream{
+		s:      s,
+		ctx:    ctx,
+		cancel: cancel,
+		id:     id,
+		typ:    typ,
+		client: typ == TypeStream,
+
+		mu:       &sync.Mutex{},
+		credited: make(chan bool, 1),
+
+		pending: make(map[int64]*Payload),
+		ready:   make(chan bool, 1),
+
+		done:     make(chan bool),
+		doneOnce: &sync.Once{},
+	}
+}
+
+// signal wakes a waiter without blocking.
+func signal(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
+
+func tableInt(t amqp.Table, k string) (int64, bool) {
+	switch v := t[k].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func tableBool(t amqp.Table, k string) bool {
+	v, _ := t[k].(bool)
+	return v
+}
+
+func (st *stream) Context() context.Context { return st.ctx }
+
+// deliver hands a message from the peer to the stream.
+func (st *stream) deliver(pl *Payload) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.route == "" && pl.Reply != "" {
+		st.route = pl.Reply
+		signal(st.credited)
+	}
+	if n, ok := tableInt(pl.Headers, headerCredit); ok {
+		st.credit += n
+		signal(st.credited)
+	}
+	if tableBool(pl.Headers, headerCancel) {
+		st.cancel()
+	}
+
+	seq, ok := tableInt(pl.Headers, headerSeq)
+	if !ok || seq < st.arrived {
+		return
+	}
+	st.pending[seq] = pl
+	signal(st.ready)
+
+	for {
+		pl, ok := st.pending[st.arrived]
+		if !ok {
+			return
+		}
+		st.arrived++
+		if st.client && tableBool(pl.Headers, headerEOS) {
+			st.finished() // every message has arrived
+		}
+	}
+}
+
+// finished marks the stream finished.
+func (st *stream) finished() {
+	st.doneOnce.Do(func() { close(st.done) })
+}
+
+// take waits until the peer is known, and has room unless eos, returning
+// its route and the sequence number of the next message.
+func (st *stream) take(eos bool) (string, int64, error) {
+	st.mu.Lock()
+	for {
+		select {
+		case <-st.done:
+			st.mu.Unlock()
+			return "", 0, io.EOF
+		default:
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return "", 0, io.EOF
+		}
+		if st.route != "" && (eos || st.credit > 0) {
+			break
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.credited:
+		case <-st.done:
+		case <-st.ctx.Done():
+			return "", 0, callError(st.ctx.Err())
+		case <-st.gone:
+			return "", 0, callError(ReplyLost)
+		case <-st.closing:
+			return "", 0, callError(ServiceClosed)
+		case <-st.s.stop:
+			return "", 0, callError(ServiceClosed)
+		}
+		st.mu.Lock()
+	}
+	defer st.mu.Unlock()
+
+	if !eos {
+		st.credit--
+	}
+	seq := st.seq
+	st.seq++
+	st.closed = eos
+	return st.route, seq, nil
+}
+
+// payload returns a message of the stream to its peer. It is waited on until
+// published, so a peer whose queue is unroutable fails the stream.
+func (st *stream) payload(route string, h amqp.Table, status *Status, b []byte) *Payload {
+	reply, _ := st.s.transport.ReplyTo()
+	return &Payload{
+		Route:   route,
+		Reply:   reply,
+		Typ:     st.typ,
+		CorId:   st.id,
+		Headers: h,
+		Body:    b,
+		Status:  status,
+		sent:    make(chan error, 1),
+	}
+}
+
+// publish sends a message of the stream to its peer.
+func (st *stream) publish(ctx context.Context, route string, h amqp.Table, status *Status, b []byte) error {
+	return st.s.Send(ctx, st.payload(route, h, status, b))
+}
+
+// cancelPeer tells the server the client gave up, once. A stream not yet
+// accepted is cancelled through the queue it was opened on. It is published
+// even if the service is stopping, so the handler does not wait on a gone
+// client.
+func (st *stream) cancelPeer() {
+	st.mu.Lock()
+	route := st.route
+	if route == "" {
+		route = st.queue
+	}
+	cancelled := st.cancelled
+	st.cancelled = true
+	st.mu.Unlock()
+
+	if cancelled {
+		return
+	}
+	st.s.transport.Publish(context.Background(), st.payload(route, amqp.Table{headerCancel: true}, nil, nil))
+}
+
+func (st *stream) SendMsg(m interface{}) error {
+	b, err := encode(m)
+	if err != nil {
+		return err
+	}
+
+	route, seq, err := st.take(false)
+	if err != nil {
+		return err
+	}
+	return st.publish(st.ctx, route, amqp.Table{headerSeq: seq}, nil, b)
+}
+
+func (st *stream) RecvMsg(m interface{}) error {
+	for {
+		st.mu.Lock()
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return err
+		}
+
+		pl, ok := st.pending[st.next]
+		if !ok {
+			st.mu.Unlock()
+
+			select {
+			case <-st.ready:
+				continue
+			case <-st.ctx.Done():
+				return callError(st.ctx.Err())
+			case <-st.gone:
+				return callError(ReplyLost)
+			case <-st.closing:
+				return callError(ServiceClosed)
+			case <-st.s.stop:
+				return callError(ServiceClosed)
+			}
+		}
+		delete(st.pending, st.next)
+		st.next++
+
+		if tableBool(pl.Headers, headerEOS) {
+			st.err = io.EOF
+			if pl.Status != nil {
+				st.err = pl.Status
+			}
+			if st.client {
+				st.trailer = tableMD(pl.Headers)
+			}
+			err := st.err
+			st.mu.Unlock()
+			return err
+		}
+
+		// grant credit once half the window is read
+		var grant int64
+		if st.read++; st.read >= (st.s.streamWindow()+1)/2 {
+			grant = st.read
+			st.read = 0
+		}
+		route := st.route
+		st.mu.Unlock()
+
+		if grant > 0 && route != "" {
+			st.publish(context.Background(), route, amqp.Table{headerCredit: grant}, nil, nil)
+		}
+		return decoder(pl.Body)(m)
+	}
+}
+
+func (st *stream) CloseSend() error {
+	route, seq, err := st.take(true)
+	if err == io.EOF {
+		return nil // already closed or finished
+	}
+	if err != nil {
+		return err
+	}
+	return st.publish(st.ctx, route, amqp.Table{headerSeq: seq, headerEOS: true}, nil, nil)
+}
+
+func (st *stream) Trailer() MD {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.trailer
+}
+
+func (st *stream) SetTrailer(md MD) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.trailer = Join(st.trailer, md)
+}
+
+// finish sends the status and trailer of a served stream to the client.
+func (st *stream) finish(err error) {
+	defer st.s.endStream(st)
+	defer st.cancel()
+	defer st.finished()
+
+	route, seq, terr := st.take(true)
+	if terr != nil {
+		return // client gone
+	}
+
+	h := amqp.Table{headerSeq: seq, headerEOS: true}
+	Join(trailerFromContext(st.ctx), st.Trailer()).table(h)
+
+	st.publish(context.Background(), route, h, Convert(err), nil)
+}
+
+// watch ends a client stream once it is finished, cancelled or its service
+// stops, telling the server unless it finished.
+func (st *stream) watch() {
+	select {
+	case <-st.done:
+	case <-st.ctx.Done():
+		st.cancelPeer()
+	case <-st.closing:
+		st.cancelPeer()
+	case <-st.s.stop:
+		st.cancelPeer()
+	}
+	st.cancel()
+	st.s.endStream(st)
+}
+
+// cancelStreams tells the servers of unfinished client streams the client
+// is going away and cancels the streams being served, before the transport
+// is closed.
+func (s *Service) cancelStreams() {
+	s.streamsMu.Lock()
+	streams := make([]*stream, 0, len(s.clientStreams))
+	for _, st := range s.clientStreams {
+		streams = append(streams, st)
+	}
+	for _, st := range s.serverStreams {
+		st.cancel()
+	}
+	s.streamsMu.Unlock()
+
+	for _, st := range streams {
+		select {
+		case <-st.done:
+		default:
+			st.cancelPeer()
+		}
+	}
+}
+
+// streamTimeout is the bound of served streams without a deadline.
+func (s *Service) streamTimeout() time.Duration {
+	if s.streamBound <= 0 {
+		return DefaultStreamTimeout
+	}
+	return s.streamBound
+}
+
+// streamWindow is the number of messages a stream buffers.
+func (s *Service) streamWindow() int64 {
+	if s.window < 1 {
+		return DefaultWindow
+	}
+	return int64(s.window)
+}
+
+// NewStream opens a stream to a method served on queue. The stream ends
+// with ctx, which should be cancelled once the stream is no longer used.
+func (s *Service) NewStream(ctx context.Context, desc *StreamDesc, queue, method string, opts ...CallOption) (ClientStream, error) {
+	c := &callInfo{}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	select {
+	case <-s.closing:
+		return nil, callError(ServiceClosed)
+	default:
+	}
+
+	deadline, _ := ctx.Deadline()
+	pl := s.NewPayload(queue, method, TypeStream, deadline, nil)
+	if pl.Reply == "" {
+		return nil, callError(ReplyLost)
+	}
+	pl.Headers = c.requestHeaders(ctx)
+	pl.Headers[headerCredit] = s.streamWindow()
+
+	ctx, cancel := context.WithCancel(ctx)
+	st := s.newStream(ctx, cancel, pl.CorId, TypeStream)
+	st.gone = pl.gone
+	st.queue = queue
+	st.closing = s.closing
+
+	s.streamsMu.Lock()
+	s.clientStreams[st.id] = st
+	s.streamsMu.Unlock()
+
+	if err := s.Send(ctx, pl); err != nil {
+		cancel()
+		s.endStream(st)
+		return nil, callError(err)
+	}
+
+	go st.watch()
+	return st, nil
+}
+
+// serveStream starts the handler of a stream opened by a client.
+func (s *Service) serveStream(pl *Payload) error {
+	if pl.Reply == "" {
+		return s.transport.Ack(pl) // drop, nowhere to stream to
+	}
+
+	if pl.Exp.IsZero() {
+		pl.Exp = time.Now().Add(s.streamTimeout())
+	}
+	ctx, cancel := pl.Context()
+	st := s.newStream(ctx, cancel, pl.CorId, TypeStreamReply)
+	st.route = pl.Reply
+	st.method = pl.MsgId
+	st.credit, _ = tableInt(pl.Headers, headerCredit)
+
+	if err := s.transport.Ack(pl); err != nil {
+		cancel()
+		return err
+	}
+
+	sm, ok := s.streams[pl.MsgId]
+	if !ok {
+		atomic.AddUint64(&s.unknown, 1)
+		st.finish(Errorf(Unimplemented, "unknown method %s for service %s", pl.MsgId, pl.Route))
+		return nil
+	}
+
+	s.streamsMu.Lock()
+	s.serverStreams[st.id] = st
+	s.streamsMu.Unlock()
+
+	// accept, telling the client where to send
+	if err := st.publish(ctx, st.route, amqp.Table{headerCredit: s.streamWindow()}, nil, nil); err != nil {
+		st.finish(err)
+		return err
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		st.finish(s.callStream(sm, st))
+	}()
+	return nil
+}
+
+// callStream calls the handler of a stream, recovering a panic as an
+// Internal error.
+func (s *Service) callStream(sm *streamMethod, st *stream) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(st.method, r)
+		}
+	}()
+	return sm.handler(sm.service, st)
+}
+
+// routeStream delivers a message to the end of its stream.
+func (s *Service) routeStream(streams map[string]*stream, pl *Payload) error {
+	if err := s.transport.Ack(pl); err != nil {
+		return err
+	}
+
+	s.streamsMu.Lock()
+	st, ok := streams[pl.CorId]
+	s.streamsMu.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&s.orphans, 1)
+		return nil
+	}
+	st.deliver(pl)
+	return nil
+}
+
+// endStream forgets a stream.
+func (s *Service) endStream(st *stream) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	if st.client {
+		delete(s.clientStreams, st.id)
+	} else {
+		delete(s.serverStreams, st.id)
+	}
+}
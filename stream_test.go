@@ -0,0 +1,369 @@
+package rrpc
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+func TestStream(t *testing.T) {
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Streams: []StreamDesc{
+			{
+				StreamName: "Echo",
+				Handler: func(srv interface{}, stream ServerStream) error {
+					for {
+						m := new(empty)
+						if err := stream.RecvMsg(m); err == io.EOF {
+							stream.SetTrailer(Pairs("echoed", "true"))
+							return nil
+						} else if err != nil {
+							return err
+						}
+						if err := stream.SendMsg(m); err != nil {
+							return err
+						}
+					}
+				},
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+			{
+				StreamName: "Fail",
+				Handler: func(srv interface{}, stream ServerStream) error {
+					return Errorf(NotFound, "no stream")
+				},
+				ServerStreams: true,
+			},
+		},
+	}
+
+	srv, cli := memoryServices(desc, nil, nil)
+	defer srv.Close()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.NewStream(ctx, &desc.Streams[0], "PingService", "Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const msgs = 200 // beyond the window
+	go func() {
+		for i := 0; i < msgs; i++ {
+			if err := stream.SendMsg(&empty{}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for i := 0; i < msgs; i++ {
+		if err := stream.RecvMsg(&empty{}); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := stream.RecvMsg(&empty{}); err != io.EOF {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+	if v := stream.Trailer().Get("echoed"); len(v) != 1 || v[0] != "true" {
+		t.Fatalf("expected the trailer, got %v", stream.Trailer())
+	}
+
+	for _, c := range []struct {
+		method string
+		code   Code
+	}{
+		{"Fail", NotFound},
+		{"Pong", Unimplemented},
+	} {
+		stream, err := cli.NewStream(ctx, &desc.Streams[1], "PingService", c.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(&empty{}); Convert(err).Code != c.code {
+			t.Fatalf("%s: expected %v, got %v", c.method, c.code, err)
+		}
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	var sent int32
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Streams: []StreamDesc{
+			{
+				StreamName: "Watch",
+				Handler: func(srv interface{}, stream ServerStream) error {
+					for i := 0; i < 10; i++ {
+						if err := stream.SendMsg(&empty{}); err != nil {
+							return err
+						}
+						atomic.AddInt32(&sent, 1)
+					}
+					return nil
+				},
+				ServerStreams: true,
+			},
+		},
+	}
+
+	srv, cli := memoryServices(desc, nil, []ServiceOption{StreamWindow(2)})
+	defer srv.Close()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := cli.NewStream(ctx, &desc.Streams[0], "PingService", "Watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n > 2 {
+		t.Fatalf("sent %d messages beyond the window", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := stream.RecvMsg(&empty{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.RecvMsg(&empty{}); err != io.EOF {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	received := make(chan bool, 1)
+	cancelled := make(chan error, 1)
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Streams: []StreamDesc{
+			{
+				StreamName: "Wait",
+				Handler: func(srv interface{}, stream ServerStream) error {
+					if err := stream.RecvMsg(&empty{}); err != nil {
+						return err
+					}
+					received <- true
+
+					err := stream.RecvMsg(&empty{})
+					cancelled <- err
+					return err
+				},
+				ClientStreams: true,
+			},
+		},
+	}
+
+	srv, cli := memoryServices(desc, nil, nil)
+	defer srv.Close()
+	defer cli.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := cli.NewStream(ctx, &desc.Streams[0], "PingService", "Wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&empty{}); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	cancel()
+
+	select {
+	case err := <-cancelled:
+		if Convert(err).Code != Canceled {
+			t.Fatalf("expected canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server stream not cancelled")
+	}
+	select {
+	case <-srv.streamsDone():
+	case <-time.After(time.Second):
+		t.Fatal("server stream not removed")
+	}
+	if err := stream.RecvMsg(&empty{}); Convert(err).Code != Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestStreamClientGone(t *testing.T) {
+	received := make(chan bool, 1)
+	ended := make(chan error, 1)
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Streams: []StreamDesc{
+			{
+				StreamName: "Wait",
+				Handler: func(srv interface{}, stream ServerStream) error {
+					if err := stream.RecvMsg(&empty{}); err != nil {
+						return err
+					}
+					received <- true
+
+					err := stream.RecvMsg(&empty{})
+					ended <- err
+					return err
+				},
+				ClientStreams: true,
+			},
+		},
+	}
+
+	for _, c := range []struct {
+		name  string
+		bound time.Duration
+		code  Code
+	}{
+		{"closed", 0, Canceled},
+		{"silent", 50 * time.Millisecond, DeadlineExceeded},
+	} {
+		srv, cli := memoryServices(desc, []ServiceOption{StreamTimeout(c.bound)}, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := cli.NewStream(ctx, &desc.Streams[0], "PingService", "Wait")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.SendMsg(&empty{}); err != nil {
+			t.Fatal(err)
+		}
+		<-received
+		if c.bound == 0 {
+			cli.Close()
+			if err := stream.RecvMsg(&empty{}); err == nil {
+				t.Fatalf("%s: stream not ended", c.name)
+			}
+		}
+
+		select {
+		case err := <-ended:
+			if Convert(err).Code != c.code {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.code, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: server stream not ended", c.name)
+		}
+		select {
+		case <-srv.streamsDone():
+		case <-time.After(time.Second):
+			t.Fatalf("%s: server stream not removed", c.name)
+		}
+
+		cancel()
+		cli.Close()
+		srv.Close()
+	}
+}
+
+func TestStreamShutdown(t *testing.T) {
+	received := make(chan bool, 1)
+	desc := &ServiceDesc{
+		ServiceName: "PingService",
+		Streams: []StreamDesc{
+			{
+				StreamName: "Wait",
+				Handler: func(srv interface{}, stream ServerStream) error {
+					if err := stream.RecvMsg(&empty{}); err != nil {
+						return err
+					}
+					received <- true
+					return stream.RecvMsg(&empty{})
+				},
+				ClientStreams: true,
+			},
+		},
+	}
+
+	srv, cli := memoryServices(desc, nil, nil)
+	defer cli.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := cli.NewStream(ctx, &desc.Streams[0], "PingService", "Wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&empty{}); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	shut := make(chan error, 1)
+	go func() { shut <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-shut:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown waits on a served stream")
+	}
+	if err := stream.RecvMsg(&empty{}); Convert(err).Code != Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+// streamsDone returns a channel closed once no streams are served.
+func (s *Service) streamsDone() <-chan bool {
+	done := make(chan bool)
+	go func() {
+		for {
+			s.streamsMu.Lock()
+			n := len(s.serverStreams)
+			s.streamsMu.Unlock()
+
+			if n == 0 {
+				close(done)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return done
+}
+
+func TestStreamReorder(t *testing.T) {
+	s := NewService()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	st := s.newStream(ctx, cancel, "reorder", TypeStream)
+
+	st.deliver(&Payload{Headers: amqp.Table{headerSeq: int64(1), headerEOS: true}})
+	select {
+	case <-st.done:
+		t.Fatal("finished before every message arrived")
+	default:
+	}
+	st.deliver(&Payload{Headers: amqp.Table{headerSeq: int64(0)}})
+	select {
+	case <-st.done:
+	default:
+		t.Fatal("not finished once every message arrived")
+	}
+
+	if err := st.RecvMsg(&empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RecvMsg(&empty{}); err != io.EOF {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+}
@@ -0,0 +1,236 @@
+package rrpc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+// Transport carries the payloads of a Service. Rabbit is the AMQP
+// transport, Memory an in process one for tests.
+type Transport interface {
+	// Publish publishes a payload to the queue named by its Route,
+	// acknowledging the request it replies to once published.
+	Publish(ctx context.Context, pl *Payload) error
+	// Consume returns the consumed payloads, closed once cancelled.
+	Consume() <-chan *Payload
+	// Ack acknowledges a consumed payload.
+	Ack(pl *Payload) error
+	// Nack rejects a consumed payload, returning it to its queue if requeue.
+	Nack(pl *Payload, requeue bool) error
+	// Requeue returns a consumed request to the queue it was served from,
+	// without counting the delivery as an attempt where attempts are
+	// limited.
+	Requeue(pl *Payload) error
+	// DeadLetter moves a consumed request that cannot be served to the dead
+	// letter queue, with the reason in its headers.
+	DeadLetter(pl *Payload, reason error) error
+	// MaxAttempts returns the number of deliveries of a request before it
+	// is dead-lettered, or 0 if not limited.
+	MaxAttempts() int
+	// ReplyTo returns the queue replies are routed to and a channel closed
+	// once it is lost.
+	ReplyTo() (string, <-chan bool)
+	// Inflight returns the number of deliveries pushed before any is
+	// acked, or 0 if not bounded.
+	Inflight() int
+	// Err returns fatal errors of the transport.
+	Err() <-chan error
+	// Cancel stops consuming, returning once Consume is closed.
+	Cancel()
+	// Close cancels and releases the transport.
+	Close() error
+}
+
+// Memory is an in process broker of queues, for testing services and
+// generated clients without RabbitMQ. Queues are created on first use.
+type Memory struct {
+	mu     *sync.Mutex
+	queues map[string]chan *Payload
+	count  uint32
+}
+
+const memoryQueueSize = 1024
+
+func NewMemory() *Memory {
+	return &Memory{
+		mu:     &sync.Mutex{},
+		queues: make(map[string]chan *Payload),
+	}
+}
+
+func (m *Memory) queue(name string) chan *Payload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[name]
+	if !ok {
+		q = make(chan *Payload, memoryQueueSize)
+		m.queues[name] = q
+	}
+	return q
+}
+
+// Transport returns a transport consuming queue, or only its own reply
+// queue if queue is empty.
+func (m *Memory) Transport(queue string) Transport {
+	t := &memory{
+		broker: m,
+		queue:  queue,
+		reply:  fmt.Sprintf("memory.reply.%d", atomic.AddUint32(&m.count, 1)),
+
+		in:         Conveyor(),
+		consuming:  &sync.WaitGroup{},
+		cancel:     make(chan bool),
+		cancelOnce: &sync.Once{},
+		stop:       make(chan bool),
+		stopOnce:   &sync.Once{},
+	}
+
+	if queue != "" {
+		t.consume(m.queue(queue))
+	}
+	t.consume(m.queue(t.reply))
+	return t
+}
+
+// memory is a Transport on a Memory broker.
+type memory struct {
+	broker *Memory
+	queue  string
+	reply  string
+
+	in         chan *Payload
+	consuming  *sync.WaitGroup
+	cancel     chan bool
+	cancelOnce *sync.Once
+	stop       chan bool
+	stopOnce   *sync.Once
+}
+
+func (t *memory) consume(q chan *Payload) {
+	t.consuming.Add(1)
+	go func() {
+		defer t.consuming.Done()
+
+		for {
+			select {
+			case pl := <-q:
+				select {
+				case t.in <- pl:
+				case <-t.cancel:
+					q <- pl // requeue
+					return
+				}
+			case <-t.cancel:
+				return
+			}
+		}
+	}()
+}
+
+// Publish copies the payload through its AMQP form, as a broker would.
+func (t *memory) Publish(ctx context.Context, pl *Payload) error {
+	p := pl.Publish()
+	q := t.broker.queue(pl.Route)
+
+	d := &amqp.Delivery{
+		Headers:       p.Headers,
+		ContentType:   p.ContentType,
+		CorrelationId: p.CorrelationId,
+		ReplyTo:       p.ReplyTo,
+		Expiration:    p.Expiration,
+		MessageId:     p.MessageId,
+		Timestamp:     p.Timestamp,
+		Type:          p.Type,
+		AppId:         p.AppId,
+		RoutingKey:    pl.Route,
+		Body:          p.Body,
+	}
+	a := &memoryAck{q: q, d: *d}
+	a.d.Acknowledger = a // redeliveries can be rejected again
+	d.Acknowledger = a
+
+	select {
+	case q <- Deliver(d):
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.stop:
+		return ServiceClosed
+	}
+
+	if pl.sent != nil {
+		pl.sent <- nil
+	}
+	return pl.Ack()
+}
+
+func (t *memory) Consume() <-chan *Payload { return t.in }
+
+func (t *memory) Ack(pl *Payload) error { return pl.Ack() }
+
+func (t *memory) Nack(pl *Payload, requeue bool) error { return pl.Nack(requeue) }
+
+// DeadLetter publishes the request to its queue name with a .dlq suffix.
+func (t *memory) DeadLetter(pl *Payload, reason error) error {
+	return t.Publish(context.Background(), deadLetter(pl, pl.Route+".dlq", reason))
+}
+
+// Requeue publishes the request to the consumed queue again with its
+// attempts, as Memory does not count redeliveries.
+func (t *memory) Requeue(pl *Payload) error {
+	return t.Publish(context.Background(), forward(pl, t.queue))
+}
+
+func (t *memory) MaxAttempts() int { return 0 }
+
+func (t *memory) ReplyTo() (string, <-chan bool) { return t.reply, nil }
+
+func (t *memory) Inflight() int { return 0 }
+
+func (t *memory) Err() <-chan error { return nil }
+
+func (t *memory) Cancel() {
+	t.cancelOnce.Do(func() {
+		close(t.cancel)
+		t.consuming.Wait()
+		close(t.in)
+	})
+}
+
+// Close cancels the transport and deletes its reply queue.
+func (t *memory) Close() error {
+	t.Cancel()
+	t.stopOnce.Do(func() {
+		close(t.stop)
+
+		t.broker.mu.Lock()
+		delete(t.broker.queues, t.reply)
+		t.broker.mu.Unlock()
+	})
+	return nil
+}
+
+// memoryAck requeues a rejected delivery on its queue.
+type memoryAck struct {
+	q chan *Payload
+	d amqp.Delivery
+}
+
+func (a *memoryAck) Ack(tag uint64, multiple bool) error { return nil }
+
+func (a *memoryAck) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		d := a.d
+		d.Redelivered = true
+		a.q <- Deliver(&d)
+	}
+	return nil
+}
+
+func (a *memoryAck) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
@@ -0,0 +1,98 @@
+package rrpc
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pingHandler returns a handler as generated for method, calling h.
+func pingHandler(method string, h UnaryHandler) methodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor UnaryServerInterceptor) (interface{}, error) {
+		in := new(empty)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return h(ctx, in)
+		}
+		info := &UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/PingService/" + method,
+		}
+		return interceptor(ctx, in, info, h)
+	}
+}
+
+var pingDesc = &ServiceDesc{
+	ServiceName: "PingService",
+	Methods: []MethodDesc{
+		{
+			MethodName: "Ping",
+			Handler: pingHandler("Ping", func(ctx context.Context, req interface{}) (interface{}, error) {
+				return req, nil
+			}),
+		},
+		{
+			MethodName: "Fail",
+			Handler: pingHandler("Fail", func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, Errorf(NotFound, "no pong")
+			}),
+		},
+	},
+}
+
+func TestMemory(t *testing.T) {
+	srv, cli := memoryServices(pingDesc, nil, nil)
+	defer srv.Close()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := cli.Invoke(ctx, "PingService", "Ping", &empty{}, &empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Invoke(ctx, "PingService", "Fail", &empty{}, &empty{}); Convert(err).Code != NotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := cli.Invoke(ctx, "PingService", "Pong", &empty{}, &empty{}); Convert(err).Code != Unimplemented {
+		t.Fatalf("expected unimplemented, got %v", err)
+	}
+}
+
+func TestMemoryRequeue(t *testing.T) {
+	m := NewMemory()
+	tr := m.Transport("PingService")
+	defer tr.Close()
+
+	ctx := context.Background()
+	if err := tr.Publish(ctx, &Payload{Route: "PingService", MsgId: "Ping"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pl := <-tr.Consume()
+	for i := 0; i < 2; i++ {
+		if err := tr.Nack(pl, true); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case pl = <-tr.Consume():
+		case <-time.After(time.Second):
+			t.Fatalf("requeue %d lost", i)
+		}
+		if pl.MsgId != "Ping" {
+			t.Fatalf("bad requeue: %+v", pl)
+		}
+	}
+	if err := tr.Ack(pl); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Cancel()
+	if _, ok := <-tr.Consume(); ok {
+		t.Fatal("consuming after cancel")
+	}
+}